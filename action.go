@@ -0,0 +1,134 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	imap "github.com/emersion/go-imap"
+)
+
+const (
+	actionDelete      = "delete"
+	actionMove        = "move"
+	actionMarkSeen    = "mark-seen"
+	actionMarkKeyword = "mark-keyword"
+)
+
+// action returns what happens to forwarded source messages, configuring
+// only a MarkFlag implies marking them with it.
+func (s *fetchSource) action() string {
+	if s.Action == "" {
+		if s.MarkFlag != "" {
+			return actionMarkKeyword
+		}
+		return actionDelete
+	}
+	return s.Action
+}
+
+func (s *fetchSource) validateAction() error {
+	switch s.action() {
+	case actionDelete:
+		return nil
+	case actionMarkSeen:
+		if s.CheckpointFile == "" {
+			return errors.New("action mark-seen requires CheckpointFile to not forward messages again after a restart")
+		}
+		return nil
+	case actionMove:
+		if s.MoveMailbox == "" {
+			return errors.New("action move requires MoveMailbox")
+		}
+		return nil
+	case actionMarkKeyword:
+		if s.MarkFlag == "" {
+			return errors.New("action mark-keyword requires MarkFlag")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid action: %s", s.Action)
+}
+
+// markedFlag returns the flag set on forwarded messages which are kept
+// in the source mailbox, so that they are not forwarded again.
+func (s *fetchSource) markedFlag() string {
+	switch s.action() {
+	case actionMarkSeen:
+		return imap.SeenFlag
+	case actionMarkKeyword:
+		return s.MarkFlag
+	}
+	return ""
+}
+
+// handledFlag returns the flag of messages which were handled by the
+// action already. Messages marked as seen may also have been read by
+// another client, so they are told apart by the highest forwarded UID.
+func (s *fetchSource) handledFlag() string {
+	switch s.action() {
+	case actionMarkSeen:
+		return ""
+	case actionMarkKeyword:
+		return s.MarkFlag
+	}
+	// Deleted messages are kept until they are expunged, which may be never.
+	return imap.DeletedFlag
+}
+
+// actionCriteria only searches for messages not yet handled by the action,
+// so that messages kept on the source are not fetched again.
+func (s *fetchSource) actionCriteria(criteria *imap.SearchCriteria, nextUid uint32) *imap.SearchCriteria {
+	if criteria == nil {
+		criteria = imap.NewSearchCriteria()
+	}
+	if handled := s.handledFlag(); handled != "" {
+		criteria.WithoutFlags = append(criteria.WithoutFlags, handled)
+	}
+	if nextUid > 1 {
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(nextUid, 0)
+	}
+	return criteria
+}
+
+// markMessages applies the configured action to forwarded messages.
+func (s *fetchSource) markMessages(seqset *imap.SeqSet) error {
+	switch s.action() {
+	case actionMarkSeen, actionMarkKeyword:
+		return s.imapconn.UidStore(seqset, imap.AddFlags,
+			[]interface{}{s.markedFlag()}, nil)
+	}
+
+	err := s.confirmMailbox()
+	if err != nil {
+		return err
+	}
+	if s.action() == actionMove {
+		return moveMessages(s.imapconn, seqset, s.MoveMailbox, s.Expunge)
+	}
+
+	err = s.imapconn.UidStore(seqset, imap.AddFlags,
+		[]interface{}{imap.DeletedFlag}, nil)
+	if err != nil {
+		return err
+	}
+	return s.expungeMessages(seqset)
+}
@@ -0,0 +1,43 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	client "github.com/emersion/go-imap/client"
+	sasl "github.com/emersion/go-sasl"
+)
+
+// login authenticates with SASL PLAIN if the server disables the LOGIN
+// command, otherwise LOGIN is used.
+func (s *FetchServer) login(con *client.Client) error {
+	disabled, err := con.Support("LOGINDISABLED")
+	if err != nil {
+		return err
+	}
+	if disabled {
+		ok, err := con.SupportAuth(sasl.Plain)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return con.Authenticate(sasl.NewPlainClient("", s.Username, s.Password))
+		}
+	}
+	return con.Login(s.Username, s.Password)
+}
@@ -0,0 +1,243 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fetchCheckpoint records the UIDs of the messages which were stored on all
+// targets, but not yet cleaned from the source. Only these messages are
+// cleaned without being forwarded again.
+//
+// If forwarded messages are kept on the source, it also records the highest
+// forwarded UID, only messages above it are fetched. Stored messages are
+// kept until it passed them, since a message stored after one failing
+// could otherwise be forwarded again.
+//
+// The checkpoint file holds the checkpoint as JSON on its first line,
+// followed by the UIDs of messages stored since, one per line. It is only
+// rewritten once messages were cleaned, so that storing each message
+// appends a single line.
+type fetchCheckpoint struct {
+	UidValidity uint32
+	Uids        []uint32
+	Forwarded   uint32
+
+	stored map[uint32]bool
+	mutex  sync.Mutex
+}
+
+func newCheckpoint(uidValidity uint32) *fetchCheckpoint {
+	return &fetchCheckpoint{UidValidity: uidValidity, stored: map[uint32]bool{}}
+}
+
+// loadCheckpoint reads the checkpoint file, without one the checkpoint
+// is only kept in memory.
+func (s *fetchSource) loadCheckpoint(uidValidity uint32) error {
+	cp := s.checkpoint
+	rewrite := false
+	if s.CheckpointFile != "" {
+		var err error
+		cp, rewrite, err = readCheckpoint(s.CheckpointFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cp == nil || cp.UidValidity != uidValidity {
+		if cp != nil && cp.UidValidity != 0 {
+			s.config.log().Warnf("UIDVALIDITY changed from %d to %d, resetting checkpoint",
+				cp.UidValidity, uidValidity)
+		}
+		cp = newCheckpoint(uidValidity)
+		rewrite = true
+	}
+	s.checkpoint = cp
+	if !rewrite {
+		return nil
+	}
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return s.writeCheckpoint()
+}
+
+// readCheckpoint reads the checkpoint file and reports whether it has to
+// be rewritten, because it is missing or its last line is incomplete.
+func readCheckpoint(name string) (*fetchCheckpoint, bool, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, true, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, err
+	}
+	cp := newCheckpoint(0)
+	err = json.Unmarshal([]byte(line), cp)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid checkpoint %s: %w", name, err)
+	}
+	for _, uid := range cp.Uids {
+		cp.stored[uid] = true
+	}
+
+	// A line without newline was cut off while storing a message, so the
+	// message is not known to be recorded.
+	for {
+		line, err = r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return cp, line != "", nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		uid, err := strconv.ParseUint(strings.TrimSpace(line), 10, 32)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid checkpoint %s: %w", name, err)
+		}
+		cp.stored[uint32(uid)] = true
+	}
+}
+
+// nextUid returns the lowest UID to fetch, messages kept on the source are
+// only fetched once.
+func (s *fetchSource) nextUid() uint32 {
+	if s.markedFlag() == "" || s.checkpoint == nil {
+		return 1
+	}
+	s.checkpoint.mutex.Lock()
+	defer s.checkpoint.mutex.Unlock()
+	return s.checkpoint.Forwarded + 1
+}
+
+// advanceCheckpoint moves the highest forwarded UID past the stored
+// messages, but not past the lowest pending message, which failed to be
+// stored and has to be fetched again.
+func (s *fetchSource) advanceCheckpoint(pending uint32) error {
+	if s.markedFlag() == "" || s.checkpoint == nil {
+		return nil
+	}
+	s.checkpoint.mutex.Lock()
+	defer s.checkpoint.mutex.Unlock()
+	forwarded := s.checkpoint.Forwarded
+	for uid := range s.checkpoint.stored {
+		if uid > forwarded && (pending == 0 || uid < pending) {
+			forwarded = uid
+		}
+	}
+	if forwarded == s.checkpoint.Forwarded {
+		return nil
+	}
+	s.checkpoint.Forwarded = forwarded
+	for uid := range s.checkpoint.stored {
+		if uid <= forwarded {
+			delete(s.checkpoint.stored, uid)
+		}
+	}
+	return s.writeCheckpoint()
+}
+
+// checkpointed reports whether the message was stored on all targets, but
+// not yet cleaned from the source.
+func (s *fetchSource) checkpointed(uid uint32) bool {
+	if s.checkpoint == nil {
+		return false
+	}
+	s.checkpoint.mutex.Lock()
+	defer s.checkpoint.mutex.Unlock()
+	return s.checkpoint.stored[uid]
+}
+
+// saveCheckpoint records that the message was stored on all targets.
+func (s *fetchSource) saveCheckpoint(uid uint32) error {
+	if s.checkpoint == nil {
+		return nil
+	}
+	s.checkpoint.mutex.Lock()
+	defer s.checkpoint.mutex.Unlock()
+	if s.checkpoint.stored[uid] {
+		return nil
+	}
+	s.checkpoint.stored[uid] = true
+	if s.CheckpointFile == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(s.CheckpointFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d\n", uid)
+	return errors.Join(err, f.Close())
+}
+
+// clearCheckpoint forgets the messages once they were cleaned from the
+// source, marked messages are forgotten once the highest forwarded UID
+// passed them.
+func (s *fetchSource) clearCheckpoint(uids []uint32) error {
+	if s.checkpoint == nil || s.markedFlag() != "" {
+		return nil
+	}
+	s.checkpoint.mutex.Lock()
+	defer s.checkpoint.mutex.Unlock()
+	for _, uid := range uids {
+		delete(s.checkpoint.stored, uid)
+	}
+	return s.writeCheckpoint()
+}
+
+// writeCheckpoint replaces the checkpoint file, the caller must hold the
+// lock of the checkpoint.
+func (s *fetchSource) writeCheckpoint() error {
+	if s.CheckpointFile == "" {
+		return nil
+	}
+
+	cp := s.checkpoint
+	cp.Uids = make([]uint32, 0, len(cp.stored))
+	for uid := range cp.stored {
+		cp.Uids = append(cp.Uids, uid)
+	}
+	slices.Sort(cp.Uids)
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := s.CheckpointFile + ".tmp"
+	err = os.WriteFile(tmp, append(data, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.CheckpointFile)
+}
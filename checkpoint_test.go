@@ -0,0 +1,217 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A message skipped by the filters is forwarded once it qualifies, instead
+// of being deleted as if it was stored already.
+func TestHandleSkippedMessageLater(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	source.addMessages(t, "INBOX", "one", "two")
+	messages := source.mailbox(t, "INBOX").Messages
+	messages[1].Flags = append(messages[1].Flags, "$Ready")
+	c := newTestConfig(t, source, target)
+	c.Source.RequireFlags = []string{"$Ready"}
+
+	err := handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "two")
+
+	messages = source.mailbox(t, "INBOX").Messages
+	messages[0].Flags = append(messages[0].Flags, "$Ready")
+	err = handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "two", "one")
+	assertSubjects(t, "source", source.subjects(t, "INBOX"))
+}
+
+// A message recorded as stored is cleaned without being forwarded again,
+// and forgotten afterwards.
+func TestHandleCheckpointed(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	source.addMessages(t, "INBOX", "one", "two")
+	c := newTestConfig(t, source, target)
+	c.Source.CheckpointFile = filepath.Join(t.TempDir(), "checkpoint.json")
+	data, err := json.Marshal(&fetchCheckpoint{UidValidity: 1, Uids: []uint32{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(c.Source.CheckpointFile, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "two")
+	assertSubjects(t, "source", source.subjects(t, "INBOX"))
+
+	data, err = os.ReadFile(c.Source.CheckpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &fetchCheckpoint{}
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.Uids) > 0 {
+		t.Errorf("cleaned messages still recorded: %v", cp.Uids)
+	}
+}
+
+func TestCheckpointed(t *testing.T) {
+	s := &fetchSource{}
+	s.config = &fetchConfig{}
+	err := s.loadCheckpoint(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []uint32{3, 1} {
+		err = s.saveCheckpoint(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for uid, want := range map[uint32]bool{1: true, 2: false, 3: true, 4: false} {
+		if got := s.checkpointed(uid); got != want {
+			t.Errorf("checkpointed(%d): got %v, want %v", uid, got, want)
+		}
+	}
+
+	err = s.clearCheckpoint([]uint32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.checkpointed(1) || !s.checkpointed(3) {
+		t.Errorf("checkpoint after cleaning 1: got %v, want [3]", s.checkpoint.stored)
+	}
+}
+
+// The highest forwarded UID only passes messages which were stored, and
+// stored messages are kept until it passed them.
+func TestAdvanceCheckpoint(t *testing.T) {
+	s := &fetchSource{Action: actionMarkKeyword, MarkFlag: "$Forwarded"}
+	s.config = &fetchConfig{}
+	err := s.loadCheckpoint(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []uint32{2, 3, 5} {
+		err = s.saveCheckpoint(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.clearCheckpoint([]uint32{2, 3, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing message 4 failed after message 5 was stored.
+	err = s.advanceCheckpoint(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.nextUid(); next != 4 {
+		t.Errorf("nextUid: got %d, want 4", next)
+	}
+	if s.checkpointed(3) || !s.checkpointed(5) {
+		t.Errorf("checkpoint after failing 4: got %v, want [5]", s.checkpoint.stored)
+	}
+
+	err = s.advanceCheckpoint(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.nextUid(); next != 6 {
+		t.Errorf("nextUid: got %d, want 6", next)
+	}
+	if s.checkpointed(5) {
+		t.Errorf("checkpoint after storing all: got %v, want []", s.checkpoint.stored)
+	}
+}
+
+// Stored messages are appended to the checkpoint file, which is rewritten
+// once messages were cleaned, ignoring a line cut off by a crash.
+func TestCheckpointFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "checkpoint.json")
+	s := &fetchSource{CheckpointFile: name}
+	s.config = &fetchConfig{}
+	err := s.loadCheckpoint(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []uint32{1, 2, 3} {
+		err = s.saveCheckpoint(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertFile(t, name, "{\"UidValidity\":1,\"Uids\":[],\"Forwarded\":0}\n1\n2\n3\n")
+
+	err = s.clearCheckpoint([]uint32{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, name, "{\"UidValidity\":1,\"Uids\":[1,3],\"Forwarded\":0}\n")
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("4\n5")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.loadCheckpoint(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for uid, want := range map[uint32]bool{1: true, 2: false, 3: true, 4: true, 5: false} {
+		if got := s.checkpointed(uid); got != want {
+			t.Errorf("checkpointed(%d): got %v, want %v", uid, got, want)
+		}
+	}
+	assertFile(t, name, "{\"UidValidity\":1,\"Uids\":[1,3,4],\"Forwarded\":0}\n")
+}
+
+func assertFile(t *testing.T, name, want string) {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("%s: got %q, want %q", name, data, want)
+	}
+}
@@ -1,13 +1,26 @@
 package main
 
 import (
+	"sync/atomic"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
 	labels               = []string{"name"}
 	accountState         = prometheus.NewDesc("mail_account_state", "State of mail accounts.", labels, nil)
-	accountMessagesTotal = prometheus.NewDesc("mail_account_messages_total", "Number of processed messages.", labels, nil)
+	accountUp            = prometheus.NewDesc("mail_account_up", "Whether mail accounts are connected.", labels, nil)
+	mailboxLabels        = []string{"name", "mailbox"}
+	accountMessagesTotal = prometheus.NewDesc("mail_account_messages_total", "Number of processed messages.", mailboxLabels, nil)
+	accountBytesTotal    = prometheus.NewDesc("mail_account_bytes_total", "Number of bytes of processed messages.", mailboxLabels, nil)
+	accountFailures      = prometheus.NewDesc("mail_account_failures_total", "Number of failed connections and handling runs.", mailboxLabels, nil)
+	accountCompressSaved = prometheus.NewDesc("mail_account_compression_saved_bytes", "Number of bytes saved by IMAP compression.", labels, nil)
+	accountWatchdogTrips = prometheus.NewDesc("mail_account_watchdog_trips_total", "Number of handling runs aborted for taking too long.", labels, nil)
+	accountLastUpdate    = prometheus.NewDesc("mail_account_last_update_timestamp_seconds", "Time of the last update received while idling.", labels, nil)
+	accountEmptyCycles   = prometheus.NewDesc("mail_account_empty_cycles_total", "Number of handling runs finding an empty mailbox.", labels, nil)
+	goroutinesAccount    = prometheus.NewDesc("mail_account_goroutines", "Number of running account goroutines.", nil, nil)
+	goroutinesHandle     = prometheus.NewDesc("mail_handle_goroutines", "Number of running message handling goroutines.", nil, nil)
+	connectionsOpen      = prometheus.NewDesc("mail_connections_open", "Number of open IMAP connections.", []string{"name", "role"}, nil)
 )
 
 // Collector implements a prometheus.Collector.
@@ -26,17 +39,102 @@ func (cc *Collector) Describe(ch chan<- *prometheus.Desc) {
 
 func (cc *Collector) Collect(ch chan<- prometheus.Metric) {
 	for _, c := range cc.config.Accounts {
+		state := c.accountState()
 		ch <- prometheus.MustNewConstMetric(
 			accountState,
 			prometheus.GaugeValue,
-			float64(c.state),
+			float64(state),
+			c.Name,
+		)
+		up := 0.0
+		if state.up() {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			accountUp,
+			prometheus.GaugeValue,
+			up,
+			c.Name,
+		)
+		for mailbox, m := range c.mailboxConfigs() {
+			ch <- prometheus.MustNewConstMetric(
+				accountMessagesTotal,
+				prometheus.CounterValue,
+				float64(atomic.LoadUint64(&m.total)),
+				c.Name, mailbox,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				accountBytesTotal,
+				prometheus.CounterValue,
+				float64(atomic.LoadUint64(&m.totalBytes)),
+				c.Name, mailbox,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				accountFailures,
+				prometheus.CounterValue,
+				float64(atomic.LoadUint64(&m.failures)),
+				c.Name, mailbox,
+			)
+		}
+		compressSaved, lastUpdate := int64(0), int64(0)
+		watchdogTrips, emptyCycles := uint64(0), uint64(0)
+		sourceIdle, sourceConns, targetConns := int64(0), int64(0), int64(0)
+		c.eachAccount(func(m *fetchConfig) {
+			compressSaved += atomic.LoadInt64(&m.compressSaved)
+			lastUpdate = max(lastUpdate, atomic.LoadInt64(&m.lastUpdate))
+			watchdogTrips += atomic.LoadUint64(&m.watchdogTrips)
+			emptyCycles += atomic.LoadUint64(&m.emptyCycles)
+			sourceIdle += atomic.LoadInt64(&m.Source.idleconns)
+			sourceConns += atomic.LoadInt64(&m.Source.connections)
+			for _, t := range m.Target {
+				targetConns += atomic.LoadInt64(&t.connections)
+			}
+		})
+		ch <- prometheus.MustNewConstMetric(
+			accountCompressSaved,
+			prometheus.GaugeValue,
+			float64(compressSaved),
+			c.Name,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			accountWatchdogTrips,
+			prometheus.CounterValue,
+			float64(watchdogTrips),
+			c.Name,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			accountLastUpdate,
+			prometheus.GaugeValue,
+			float64(lastUpdate),
 			c.Name,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			accountMessagesTotal,
+			accountEmptyCycles,
 			prometheus.CounterValue,
-			float64(c.total),
+			float64(emptyCycles),
 			c.Name,
 		)
+		for role, conns := range map[string]int64{
+			"source-idle": sourceIdle,
+			"source-imap": sourceConns,
+			"target-imap": targetConns,
+		} {
+			ch <- prometheus.MustNewConstMetric(
+				connectionsOpen,
+				prometheus.GaugeValue,
+				float64(conns),
+				c.Name, role,
+			)
+		}
 	}
+	ch <- prometheus.MustNewConstMetric(
+		goroutinesAccount,
+		prometheus.GaugeValue,
+		float64(atomic.LoadInt64(&accountGoroutines)),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		goroutinesHandle,
+		prometheus.GaugeValue,
+		float64(atomic.LoadInt64(&handleGoroutines)),
+	)
 }
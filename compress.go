@@ -0,0 +1,187 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	client "github.com/emersion/go-imap/client"
+)
+
+// compressCommand is a COMPRESS command, as defined in RFC 4978.
+type compressCommand struct {
+	Mechanism string
+}
+
+func (cmd *compressCommand) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "COMPRESS",
+		Arguments: []interface{}{imap.RawString(cmd.Mechanism)},
+	}
+}
+
+// deflateConn compresses a connection with DEFLATE once the server
+// accepted the COMPRESS command, counting the bytes saved by it.
+type deflateConn struct {
+	net.Conn
+
+	mutex    sync.Mutex
+	switched chan struct{}
+	r        io.Reader
+	w        *flate.Writer
+	saved    *int64
+}
+
+func newDeflateConn(conn net.Conn, saved *int64) *deflateConn {
+	return &deflateConn{Conn: conn, saved: saved}
+}
+
+type countingReader struct {
+	r     io.Reader
+	saved *int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.saved, -int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w     io.Writer
+	saved *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.saved, -int64(n))
+	return n, err
+}
+
+// start switches the connection to DEFLATE compression, the server already
+// compresses everything following its response to the COMPRESS command.
+//
+// go-imap keeps reading right after that response, so the waiting read is
+// interrupted with a deadline and switches to decompressing before the
+// next command is sent.
+func (c *deflateConn) start() error {
+	switched := make(chan struct{})
+	c.mutex.Lock()
+	c.switched = switched
+	c.mutex.Unlock()
+
+	err := c.Conn.SetReadDeadline(time.Now())
+	if err != nil {
+		return err
+	}
+	<-switched
+	if c.reader() == nil {
+		return errors.New("connection closed while starting compression")
+	}
+
+	w, err := flate.NewWriter(&countingWriter{w: c.Conn, saved: c.saved}, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.w = w
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *deflateConn) reader() io.Reader {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.r
+}
+
+// interrupted finishes the switch started by start if err is caused by
+// its deadline, any other error aborts the switch.
+func (c *deflateConn) interrupted(err error) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.switched == nil || err == nil {
+		return false
+	}
+	defer close(c.switched)
+	c.switched = nil
+	if !errors.Is(err, os.ErrDeadlineExceeded) || c.Conn.SetReadDeadline(time.Time{}) != nil {
+		return false
+	}
+	c.r = flate.NewReader(&countingReader{r: c.Conn, saved: c.saved})
+	return true
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	r := c.reader()
+	if r == nil {
+		n, err := c.Conn.Read(b)
+		if !c.interrupted(err) {
+			return n, err
+		}
+		r = c.reader()
+	}
+	n, err := r.Read(b)
+	atomic.AddInt64(c.saved, int64(n))
+	return n, err
+}
+
+func (c *deflateConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	w := c.w
+	c.mutex.Unlock()
+	if w == nil {
+		return c.Conn.Write(b)
+	}
+
+	n, err := w.Write(b)
+	if err == nil {
+		err = w.Flush()
+	}
+	atomic.AddInt64(c.saved, int64(n))
+	return n, err
+}
+
+// compress enables DEFLATE compression if the server supports it.
+func (s *FetchServer) compress(con *client.Client, conn *deflateConn) error {
+	ok, err := con.Support("COMPRESS=DEFLATE")
+	if err != nil || !ok {
+		return err
+	}
+
+	return con.Upgrade(func(upgraded net.Conn) (net.Conn, error) {
+		status, err := con.Execute(&compressCommand{Mechanism: "DEFLATE"}, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = status.Err()
+		if err != nil {
+			return nil, err
+		}
+		return upgraded, conn.start()
+	})
+}
@@ -0,0 +1,94 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+	stdlog "log"
+	"net"
+	"strings"
+	"testing"
+
+	client "github.com/emersion/go-imap/client"
+)
+
+// serveCompress answers the COMPRESS command and a NOOP sent compressed.
+func serveCompress(conn net.Conn) error {
+	defer conn.Close()
+	_, err := conn.Write([]byte("* OK [CAPABILITY IMAP4rev1 COMPRESS=DEFLATE] ready\r\n"))
+	if err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	tag := strings.Fields(line)[0]
+	_, err = conn.Write([]byte(tag + " OK DEFLATE active\r\n"))
+	if err != nil {
+		return err
+	}
+
+	w, err := flate.NewWriter(conn, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(flate.NewReader(conn))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		_, err = w.Write([]byte("* OK still compressed\r\n" + fields[0] + " OK " + fields[1] + " done\r\n"))
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	go serveCompress(serverConn)
+
+	saved := int64(0)
+	deflate := newDeflateConn(clientConn, &saved)
+	con, err := client.New(deflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con.ErrorLog = stdlog.New(io.Discard, "", 0)
+	defer con.Terminate()
+
+	err = new(FetchServer).compress(con, deflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = con.Noop()
+		if err != nil {
+			t.Fatalf("NOOP %d after COMPRESS: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	imap "github.com/emersion/go-imap"
+	commands "github.com/emersion/go-imap/commands"
+	responses "github.com/emersion/go-imap/responses"
+)
+
+const statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+type modSeqState struct {
+	UidValidity uint32
+	ModSeq      uint64
+}
+
+// fetchChangedSince is a FETCH command with the CHANGEDSINCE modifier, as
+// defined in RFC 7162 section 3.1.4.
+type fetchChangedSince struct {
+	commands.Fetch
+	ModSeq uint64
+}
+
+func (cmd *fetchChangedSince) Command() *imap.Command {
+	c := cmd.Fetch.Command()
+	c.Arguments = append(c.Arguments, []interface{}{
+		imap.RawString("CHANGEDSINCE"),
+		imap.RawString(strconv.FormatUint(cmd.ModSeq, 10)),
+	})
+	return c
+}
+
+// statusModSeq returns the HIGHESTMODSEQ of the source mailbox,
+// or 0 if the server does not support CONDSTORE.
+func (s *fetchSource) statusModSeq() (uint64, error) {
+	ok, err := s.imapconn.Support("CONDSTORE")
+	if err != nil || !ok {
+		return 0, err
+	}
+	status, err := s.imapconn.Status(s.Mailbox, []imap.StatusItem{statusHighestModSeq})
+	if err != nil {
+		return 0, err
+	}
+	value, ok := status.Items[statusHighestModSeq]
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseUint(fmt.Sprint(value), 10, 64)
+}
+
+func (s *fetchSource) uidFetchChangedSince(seqset *imap.SeqSet, items []imap.FetchItem,
+	modSeq uint64, messages chan *imap.Message) error {
+	defer close(messages)
+
+	cmd := &commands.Uid{Cmd: &fetchChangedSince{
+		Fetch:  commands.Fetch{SeqSet: seqset, Items: items},
+		ModSeq: modSeq,
+	}}
+	res := &responses.Fetch{Messages: messages, SeqSet: seqset, Uid: true}
+
+	status, err := s.imapconn.Execute(cmd, res)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+func (s *fetchSource) commitModSeq() {
+	s.modSeq = s.nextModSeq
+}
@@ -18,30 +18,66 @@
 
 package main
 
-import "github.com/spf13/viper"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rollbar/rollbar-go"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
 
 type configLogging struct {
-	Level string
+	Level         string
+	PerAccountDir string
 }
 
 type configMetrics struct {
 	ListenAddress string
+	TLSCert       string
+	TLSKey        string
+	Username      string
+	Password      string
 }
 
 type configRollbar struct {
 	AccessToken string
 	Environment string
+	CodeVersion string
+	ServerHost  string
+	Custom      map[string]string
+
+	client *rollbar.Client
+}
+
+type configSentry struct {
+	DSN         string
+	Environment string
+	Release     string
+
+	client *sentry.Client
 }
 
 type config struct {
 	Accounts []*fetchConfig
 
+	MaxConcurrentHandles int
+
 	Logging *configLogging
 	Metrics *configMetrics
 	Rollbar *configRollbar
+	Sentry  *configSentry
+	MQTT    *configMQTT
+	Debug   *configDebug
 }
 
-func loadConfig() (*config, error) {
+// loadConfig reads the base config file and, if configDir is set, the
+// config files in it, in which case the base config file is optional.
+func loadConfig(configDir string) (*config, error) {
 	vpr := viper.GetViper()
 	vpr.SetConfigName("go-getmail")
 	vpr.AddConfigPath("/etc/go-getmail/")
@@ -49,7 +85,10 @@ func loadConfig() (*config, error) {
 	vpr.AddConfigPath(".")
 	err := vpr.ReadInConfig()
 	if err != nil {
-		return nil, err
+		var notFound viper.ConfigFileNotFoundError
+		if configDir == "" || !errors.As(err, &notFound) {
+			return nil, err
+		}
 	}
 
 	var cfg config
@@ -57,5 +96,118 @@ func loadConfig() (*config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if configDir != "" {
+		err = cfg.loadDir(configDir, vpr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = cfg.resolveSecrets()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
+
+// selectAccount drops all accounts except the named one.
+func (cfg *config) selectAccount(name string) error {
+	for _, c := range cfg.Accounts {
+		if c.Name == name {
+			cfg.Accounts = []*fetchConfig{c}
+			return nil
+		}
+	}
+	return fmt.Errorf("account %s not found", name)
+}
+
+// validate checks the whole configuration and reports all problems found.
+func (cfg *config) validate() error {
+	errs := []error{}
+	if cfg.MaxConcurrentHandles < 0 {
+		errs = append(errs, fmt.Errorf("MaxConcurrentHandles must not be negative"))
+	}
+	if cfg.Logging != nil && cfg.Logging.Level != "" {
+		_, err := log.ParseLevel(cfg.Logging.Level)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("logging: %w", err))
+		}
+	}
+	names := map[string]int{}
+	for _, c := range cfg.Accounts {
+		names[c.Name]++
+	}
+	duplicates := []string{}
+	for name, count := range names {
+		if count > 1 {
+			duplicates = append(duplicates, name)
+		}
+	}
+	if len(duplicates) > 0 {
+		sort.Strings(duplicates)
+		errs = append(errs, fmt.Errorf("duplicate account names: %s", strings.Join(duplicates, ", ")))
+	}
+	if cfg.Metrics != nil {
+		err := cfg.Metrics.validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("metrics: %w", err))
+		}
+	}
+	_, err := cfg.reporter()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	err = cfg.validateDebug()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("debug: %w", err))
+	}
+	for _, c := range cfg.Accounts {
+		err := c.validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", c.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the account and reports all problems found.
+func (c *fetchConfig) validate() error {
+	errs := []error{}
+	if c.LogLevel != "" {
+		_, err := log.ParseLevel(c.LogLevel)
+		errs = append(errs, err)
+	}
+	if c.ReconnectJitter != nil && (*c.ReconnectJitter < 0 || *c.ReconnectJitter > 1) {
+		errs = append(errs, errors.New("ReconnectJitter must be between 0 and 1"))
+	}
+	_, err := c.Source.address()
+	errs = append(errs, err,
+		c.Source.TLS.validate(),
+		c.Source.validateMailboxPattern(),
+		c.Source.validateConfirmMailbox(),
+		c.Source.validateWindow(),
+		c.Source.validateSize(),
+		c.Source.Filter.compile(),
+		c.Source.validateFilterMode())
+	if len(c.Target) < 1 {
+		errs = append(errs, errors.New("no target configured"))
+	}
+	for _, t := range c.Target {
+		_, err = t.address()
+		errs = append(errs, err,
+			t.TLS.validate(),
+			t.validateFlags(),
+			t.validateInternalDate(),
+			t.validateDateFolder(),
+			t.validateMailboxPrefix())
+	}
+	errs = append(errs,
+		c.Source.validateAction(),
+		c.Source.validateExpunge(),
+		c.Source.validateDeleteMode(),
+		c.Pipeline.validate())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,71 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func newValidAccount(name string) *fetchConfig {
+	c := &fetchConfig{Name: name}
+	c.Source.Server = "source.example.org"
+	c.Source.Mailbox = "INBOX"
+	c.Target = fetchTargets{{FetchServer: FetchServer{Server: "target.example.org", Mailbox: "INBOX"}}}
+	return c
+}
+
+func TestValidateDuplicateNames(t *testing.T) {
+	cfg := &config{Accounts: []*fetchConfig{newValidAccount("a"), newValidAccount("b")}}
+	err := cfg.validate()
+	if err != nil {
+		t.Fatalf("unique names: %v", err)
+	}
+
+	cfg.Accounts = append(cfg.Accounts, newValidAccount("a"), newValidAccount("c"), newValidAccount("c"))
+	err = cfg.validate()
+	if err == nil {
+		t.Fatal("duplicate names accepted")
+	}
+	if !strings.Contains(err.Error(), "duplicate account names: a, c") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateAccountErrors(t *testing.T) {
+	c := newValidAccount("a")
+	jitter := 2.0
+	c.ReconnectJitter = &jitter
+	c.Source.Mailbox = ""
+	c.Target[0].TLS.ClientCertFile = "client.crt"
+
+	err := (&config{Accounts: []*fetchConfig{c}}).validate()
+	if err == nil {
+		t.Fatal("invalid account accepted")
+	}
+	for _, want := range []string{
+		"account a: ReconnectJitter must be between 0 and 1",
+		"either Mailbox or MailboxPattern must be configured",
+		"TLS client certificate and key must be configured together",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in: %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// globalKeys returns the settings of a config file besides its accounts.
+func globalKeys(vpr *viper.Viper) []string {
+	keys := []string{}
+	for key := range vpr.AllSettings() {
+		if key != "accounts" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// loadDir adds the accounts of all config files in dir. Global settings
+// may only be configured in one of the files, including the base file.
+func (cfg *config) loadDir(dir string, base *viper.Viper) error {
+	owners := map[string]string{}
+	for _, key := range globalKeys(base) {
+		owners[key] = base.ConfigFileUsed()
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		vpr := viper.New()
+		vpr.SetConfigFile(file)
+		err = vpr.ReadInConfig()
+		if err != nil {
+			return err
+		}
+		for _, key := range globalKeys(vpr) {
+			if owner, ok := owners[key]; ok {
+				return fmt.Errorf("%s: %s is already configured in %s", file, key, owner)
+			}
+			owners[key] = file
+		}
+
+		var part config
+		err = vpr.UnmarshalExact(&part)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		cfg.merge(&part)
+	}
+	return nil
+}
+
+// merge adds the accounts and global settings of another config file.
+func (cfg *config) merge(part *config) {
+	cfg.Accounts = append(cfg.Accounts, part.Accounts...)
+	if part.MaxConcurrentHandles != 0 {
+		cfg.MaxConcurrentHandles = part.MaxConcurrentHandles
+	}
+	if part.Logging != nil {
+		cfg.Logging = part.Logging
+	}
+	if part.Metrics != nil {
+		cfg.Metrics = part.Metrics
+	}
+	if part.Rollbar != nil {
+		cfg.Rollbar = part.Rollbar
+	}
+	if part.Sentry != nil {
+		cfg.Sentry = part.Sentry
+	}
+	if part.MQTT != nil {
+		cfg.MQTT = part.MQTT
+	}
+	if part.Debug != nil {
+		cfg.Debug = part.Debug
+	}
+}
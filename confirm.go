@@ -0,0 +1,49 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errMailboxNotConfirmed = errors.New("selected mailbox does not match ConfirmMailbox")
+
+func (s *fetchSource) validateConfirmMailbox() error {
+	if s.ConfirmMailbox != "" && s.MailboxPattern != "" {
+		return errors.New("ConfirmMailbox cannot be combined with MailboxPattern")
+	}
+	return nil
+}
+
+// confirmMailbox guards against removing messages from the wrong mailbox
+// due to a configuration mistake, if ConfirmMailbox is set.
+func (s *fetchSource) confirmMailbox() error {
+	if s.ConfirmMailbox == "" {
+		return nil
+	}
+	selected := ""
+	if mailbox := s.imapconn.Mailbox(); mailbox != nil {
+		selected = mailbox.Name
+	}
+	if selected != s.ConfirmMailbox {
+		return fmt.Errorf("%w: %q is not %q", errMailboxNotConfirmed, selected, s.ConfirmMailbox)
+	}
+	return nil
+}
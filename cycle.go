@@ -0,0 +1,51 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+)
+
+// limitCycle returns the first MaxPerCycle of the UIDs to fetch and
+// records where the next cycle continues if there are more.
+func (s *fetchSource) limitCycle(uids []uint32) []uint32 {
+	if s.MaxPerCycle <= 0 || len(uids) <= s.MaxPerCycle {
+		return uids
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	uids = uids[:s.MaxPerCycle]
+	s.truncated = true
+	s.resumeUid = uids[len(uids)-1] + 1
+	s.config.log().Infof("Limiting cycle to %d messages", s.MaxPerCycle)
+	return uids
+}
+
+// handleAll handles messages in cycles of at most MaxPerCycle messages,
+// releasing the handling slot and checking for shutdown in between.
+func (c *fetchConfig) handleAll() error {
+	defer func() {
+		c.Source.resumeUid = 0
+	}()
+	for {
+		err := c.handle()
+		if err != nil || !c.Source.truncated || c.ctx.Err() != nil {
+			return err
+		}
+	}
+}
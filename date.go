@@ -0,0 +1,59 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"time"
+)
+
+const (
+	internalDateOriginal = "original"
+	internalDateNow      = "now"
+	internalDateHeader   = "header"
+)
+
+func (t *fetchTarget) validateInternalDate() error {
+	switch t.InternalDate {
+	case "", internalDateOriginal, internalDateNow, internalDateHeader:
+		return nil
+	}
+	return fmt.Errorf("invalid internal date policy: %s", t.InternalDate)
+}
+
+// internalDate returns the date a message is appended with, falling back
+// to the current time if the chosen date is missing or invalid.
+func (t *fetchTarget) internalDate(date time.Time, data []byte) time.Time {
+	switch t.InternalDate {
+	case internalDateNow:
+		date = time.Time{}
+	case internalDateHeader:
+		date = time.Time{}
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err == nil {
+			date, _ = msg.Header.Date()
+		}
+	}
+	if date.IsZero() {
+		return time.Now()
+	}
+	return date
+}
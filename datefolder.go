@@ -0,0 +1,51 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func (t *fetchTarget) validateDateFolder() error {
+	if t.DateFolderTemplate != "" && t.GmailLabel != "" {
+		return errors.New("GmailLabel cannot be combined with DateFolderTemplate")
+	}
+	return nil
+}
+
+// dateFolder returns the mailbox a message received at date is appended
+// to, creating it on first use if it is chosen by the date.
+func (t *fetchTarget) dateFolder(date time.Time) (string, error) {
+	if t.DateFolderTemplate == "" {
+		return t.mailbox, nil
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	name := date.Format(t.DateFolderTemplate)
+	if !t.folders[name] {
+		err := t.createMailbox(name)
+		if err != nil {
+			return "", err
+		}
+		t.folders[name] = true
+	}
+	return name, nil
+}
@@ -0,0 +1,52 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/pprof"
+)
+
+type configDebug struct {
+	Pprof bool
+}
+
+func (cfg *config) validateDebug() error {
+	if cfg.Debug == nil || !cfg.Debug.Pprof {
+		return nil
+	}
+	if cfg.Metrics == nil || cfg.Metrics.ListenAddress == "" {
+		return errors.New("pprof requires Metrics.ListenAddress")
+	}
+	return nil
+}
+
+// registerPprof serves the runtime profiles on /debug/pprof/ next to the
+// metrics, protected the same way.
+func (d *configDebug) registerPprof(mux *http.ServeMux, m *configMetrics) {
+	if d == nil || !d.Pprof {
+		return
+	}
+	mux.Handle("/debug/pprof/", m.protect(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", m.protect(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", m.protect(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", m.protect(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", m.protect(http.HandlerFunc(pprof.Trace)))
+}
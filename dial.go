@@ -0,0 +1,171 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// defaultPort is the port of IMAP over implicit TLS.
+const defaultPort = 993
+
+// fetchTLS contains the optional TLS client certificate and the optional
+// certificate authorities to verify the server against.
+type fetchTLS struct {
+	ClientCertFile string
+	ClientKeyFile  string
+	CAFile         string
+}
+
+func (t *fetchTLS) validate() error {
+	if (t.ClientCertFile == "") != (t.ClientKeyFile == "") {
+		return errors.New("TLS client certificate and key must be configured together")
+	}
+	return nil
+}
+
+func (t *fetchTLS) config(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+	}
+	if t.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCertFile, t.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// address returns the host and port to connect to, the port can be part
+// of Server or be configured separately.
+func (s *FetchServer) address() (string, error) {
+	if _, _, err := net.SplitHostPort(s.Server); err == nil {
+		if s.Port != 0 {
+			return "", fmt.Errorf("port of %s is configured twice", s.Server)
+		}
+		return s.Server, nil
+	}
+	port := s.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return net.JoinHostPort(s.Server, strconv.Itoa(port)), nil
+}
+
+// connectAddress returns the address to dial, which differs from the
+// address of Server if it is overridden, e.g. for split-horizon DNS.
+// The port of Server is used unless the override contains one.
+func (s *FetchServer) connectAddress(address string) (string, error) {
+	if s.ConnectAddress == "" {
+		return address, nil
+	}
+	if _, _, err := net.SplitHostPort(s.ConnectAddress); err == nil {
+		return s.ConnectAddress, nil
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(s.ConnectAddress, port), nil
+}
+
+func (s *FetchServer) dialer() (proxy.Dialer, error) {
+	direct := &net.Dialer{Timeout: s.timeout()}
+	if s.Proxy == "" {
+		return direct, nil
+	}
+	u, err := url.Parse(s.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.FromURL(u, direct)
+}
+
+// dial connects to the server, optionally through a proxy, and starts TLS.
+func (s *FetchServer) dial() (net.Conn, error) {
+	address, err := s.address()
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.connectAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := s.dialer()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(s.config.ctx, s.timeout())
+	defer cancel()
+
+	var conn net.Conn
+	if d, ok := dialer.(proxy.ContextDialer); ok {
+		conn, err = d.DialContext(ctx, "tcp", target)
+	} else {
+		conn, err = dialer.Dial("tcp", target)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The certificate is verified against Server, even if the connection
+	// was made to another address.
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConfig, err := s.TLS.config(host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	// The deadline covers the TLS handshake and the server greeting,
+	// afterwards each command sets its own deadline.
+	err = tlsConn.SetDeadline(time.Now().Add(s.timeout()))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
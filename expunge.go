@@ -0,0 +1,138 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	imap "github.com/emersion/go-imap"
+	client "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+const (
+	expungeAlways = "always"
+	expungeNever  = "never"
+	expungeUid    = "uid"
+)
+
+const (
+	deleteModeBatch      = "batch"
+	deleteModePerMessage = "per-message"
+)
+
+// expungeCommand is an EXPUNGE command limited to a set of messages, it
+// must be wrapped in a UID command as defined in RFC 4315.
+type expungeCommand struct {
+	SeqSet *imap.SeqSet
+}
+
+func (cmd *expungeCommand) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "EXPUNGE",
+		Arguments: []interface{}{cmd.SeqSet},
+	}
+}
+
+func (s *fetchSource) validateExpunge() error {
+	switch s.Expunge {
+	case "", expungeAlways, expungeNever, expungeUid:
+		return nil
+	}
+	return fmt.Errorf("invalid expunge policy: %s", s.Expunge)
+}
+
+func (s *fetchSource) validateDeleteMode() error {
+	switch s.DeleteMode {
+	case "", deleteModeBatch, deleteModePerMessage:
+		return nil
+	}
+	return fmt.Errorf("invalid delete mode: %s", s.DeleteMode)
+}
+
+// expungeMessages permanently removes the deleted messages according to
+// the expunge policy and logs how many messages were removed.
+func (s *fetchSource) expungeMessages(seqset *imap.SeqSet) error {
+	var expunge func(ch chan uint32) error
+	switch s.Expunge {
+	case expungeNever:
+		return nil
+	case expungeUid:
+		ok, err := s.imapconn.Support("UIDPLUS")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			s.config.log().Warnf("UIDPLUS not supported by %s, leaving messages for expunge", s.Server)
+			return nil
+		}
+		expunge = func(ch chan uint32) error {
+			defer close(ch)
+			return uidExpunge(s.imapconn, seqset, ch)
+		}
+	default:
+		expunge = s.imapconn.Expunge
+	}
+
+	ch := make(chan uint32, 10)
+	count := make(chan int, 1)
+	go func() {
+		n := 0
+		for range ch {
+			n++
+		}
+		count <- n
+	}()
+	err := expunge(ch)
+	expunged := <-count
+	if err != nil {
+		return fmt.Errorf("expunge: %w", err)
+	}
+
+	s.config.log().Infof("Expunged messages: %d", expunged)
+	if deleted := seqsetSize(seqset); expunged < deleted {
+		s.config.log().Warnf("Only %d of %d deleted messages were expunged", expunged, deleted)
+	}
+	return nil
+}
+
+// uidExpunge permanently removes only the given deleted messages, the
+// server must support UIDPLUS. If ch is not nil, the sequence numbers of
+// the removed messages are sent to it.
+func uidExpunge(con *client.Client, seqset *imap.SeqSet, ch chan uint32) error {
+	var h responses.Handler
+	if ch != nil {
+		h = &responses.Expunge{SeqNums: ch}
+	}
+	status, err := con.Execute(&commands.Uid{Cmd: &expungeCommand{SeqSet: seqset}}, h)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// seqsetSize returns the number of messages in a set of explicit UIDs.
+func seqsetSize(seqset *imap.SeqSet) int {
+	n := 0
+	for _, seq := range seqset.Set {
+		n += int(seq.Stop-seq.Start) + 1
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandleExpunge(t *testing.T) {
+	for _, tc := range []struct {
+		expunge string
+		left    int
+		logged  string
+	}{
+		{"", 0, "Expunged messages: 3"},
+		{expungeAlways, 0, "Expunged messages: 3"},
+		{expungeNever, 3, ""},
+		// The in-memory server does not support UIDPLUS.
+		{expungeUid, 3, "UIDPLUS not supported by "},
+	} {
+		t.Run(tc.expunge, func(t *testing.T) {
+			source, target := newTestServer(t), newTestServer(t)
+			source.addMessages(t, "INBOX", "one", "two", "three")
+			c := newTestConfig(t, source, target)
+			c.Source.Expunge = tc.expunge
+			hook := test.NewLocal(c.logger)
+
+			err := handleOnce(t, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages := source.mailbox(t, "INBOX").Messages
+			if len(messages) != tc.left {
+				t.Errorf("messages left on the source: got %d, want %d", len(messages), tc.left)
+			}
+			for _, msg := range messages {
+				if !hasFlag(msg.Flags, imap.DeletedFlag) {
+					t.Errorf("message %d left without deleted flag", msg.Uid)
+				}
+			}
+			if tc.logged != "" && !logged(hook, tc.logged) {
+				t.Errorf("not logged: %s", tc.logged)
+			}
+		})
+	}
+}
+
+// Messages deleted but not expunged are not fetched again.
+func TestHandleExpungeNeverRefetch(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	source.addMessages(t, "INBOX", "one", "two")
+	c := newTestConfig(t, source, target)
+	c.Source.Expunge = expungeNever
+
+	err := handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := test.NewLocal(c.logger)
+	err = handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logged(hook, "Handling message: ") {
+		t.Error("deleted message fetched again")
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "one", "two")
+}
+
+// logged reports whether a message starting with prefix was logged.
+func logged(hook *test.Hook, prefix string) bool {
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, prefix) {
+			return true
+		}
+	}
+	return false
+}
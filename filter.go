@@ -0,0 +1,93 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+
+	message "github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	textproto "github.com/emersion/go-message/textproto"
+)
+
+type fetchFilter struct {
+	From          string
+	To            string
+	Subject       string
+	Headers       map[string]string
+	CaseSensitive bool
+
+	patterns map[string]*regexp.Regexp
+}
+
+func (f *fetchFilter) compile() error {
+	exprs := map[string]string{}
+	for key, expr := range f.Headers {
+		exprs[key] = expr
+	}
+	for key, expr := range map[string]string{
+		"From":    f.From,
+		"To":      f.To,
+		"Subject": f.Subject,
+	} {
+		if expr != "" {
+			exprs[key] = expr
+		}
+	}
+
+	f.patterns = make(map[string]*regexp.Regexp, len(exprs))
+	for key, expr := range exprs {
+		if !f.CaseSensitive {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid filter for %s: %w", key, err)
+		}
+		f.patterns[key] = re
+	}
+	return nil
+}
+
+// match reports whether the header of the message matches all patterns.
+func (f *fetchFilter) match(data []byte) (bool, error) {
+	if len(f.patterns) == 0 {
+		return true, nil
+	}
+
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return false, err
+	}
+	h := message.Header{Header: header}
+
+	for key, re := range f.patterns {
+		value, err := h.Text(key)
+		if err != nil {
+			value = h.Get(key)
+		}
+		if !re.MatchString(value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,85 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	imap "github.com/emersion/go-imap"
+)
+
+const (
+	flagsDefault     = ""
+	flagsPreserveAll = "preserve-all"
+	flagsNone        = "none"
+)
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fetchTarget) validateFlags() error {
+	switch t.Flags {
+	case flagsDefault, flagsPreserveAll, flagsNone:
+		return nil
+	}
+	return fmt.Errorf("invalid flags policy: %s", t.Flags)
+}
+
+func (t *fetchTarget) keepFlag(flag string) bool {
+	if hasFlag(t.DenyFlags, flag) {
+		return false
+	}
+	if len(t.AllowFlags) > 0 {
+		return hasFlag(t.AllowFlags, flag)
+	}
+	switch t.Flags {
+	case flagsPreserveAll:
+		return true
+	case flagsNone:
+		return false
+	}
+	return !strings.EqualFold(flag, imap.SeenFlag)
+}
+
+// forwardFlags reports whether a message with these flags is to be forwarded,
+// it must have none of the SkipFlags and all of the RequireFlags. Messages
+// flagged by the configured action have already been handled.
+func (s *fetchSource) forwardFlags(flags []string) bool {
+	if handled := s.handledFlag(); handled != "" && hasFlag(flags, handled) {
+		return false
+	}
+	for _, flag := range s.SkipFlags {
+		if hasFlag(flags, flag) {
+			return false
+		}
+	}
+	for _, flag := range s.RequireFlags {
+		if !hasFlag(flags, flag) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// gmailCapability is advertised by Gmail, which supports labels.
+const gmailCapability = "X-GM-EXT-1"
+
+// labelMessage applies the configured Gmail label to an appended message.
+// Other servers and messages without a known UID are left unchanged.
+func (t *fetchTarget) labelMessage(uid uint32) error {
+	if t.GmailLabel == "" {
+		return nil
+	}
+	ok, err := t.imapconn.Support(gmailCapability)
+	if err != nil || !ok {
+		return err
+	}
+	if uid == 0 {
+		t.config.log().Warnf("Cannot label message without APPENDUID on %s", t.Server)
+		return nil
+	}
+
+	// Unlike mailbox names, go-imap does not encode labels as modified UTF-7.
+	label, err := utf7.Encoding.NewEncoder().String(t.GmailLabel)
+	if err != nil {
+		return err
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	item := imap.StoreItem("+X-GM-LABELS")
+	return t.imapconn.UidStore(seqset, item, []interface{}{label}, nil)
+}
@@ -5,22 +5,28 @@ go 1.22.0
 toolchain go1.23.5
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.5.0
 	github.com/emersion/go-imap v1.2.1
 	github.com/emersion/go-imap-idle v0.0.0-20210907174914-db2568431445
+	github.com/emersion/go-message v0.15.0
+	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6
+	github.com/getsentry/sentry-go v0.30.0
 	github.com/heroku/rollrus v0.2.0
 	github.com/prometheus/client_golang v1.20.5
 	github.com/rollbar/rollbar-go v1.4.5
 	github.com/rollbar/rollbar-go/errors v1.0.0
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/viper v1.19.0
+	golang.org/x/net v0.33.0
 	golang.org/x/sync v0.10.0
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6 // indirect
+	github.com/emersion/go-textwrapper v0.0.0-20200911093747-65d896831594 // indirect
 	github.com/fsnotify/fsnotify v1.8.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/magiconair/properties v1.8.9 // indirect
@@ -0,0 +1,37 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "sync/atomic"
+
+// The numbers of running goroutines per kind, for detecting leaks over
+// long runtimes together with the number of open connections.
+var (
+	accountGoroutines int64
+	handleGoroutines  int64
+)
+
+// trackGoroutine counts a running goroutine until the returned function
+// is called, which is meant to be deferred.
+func trackGoroutine(counter *int64) func() {
+	atomic.AddInt64(counter, 1)
+	return func() {
+		atomic.AddInt64(counter, -1)
+	}
+}
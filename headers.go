@@ -0,0 +1,101 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	imap "github.com/emersion/go-imap"
+)
+
+const (
+	filterModeSinglePass   = "single-pass"
+	filterModeHeadersFirst = "headers-first"
+)
+
+func (s *fetchSource) validateFilterMode() error {
+	switch s.FilterMode {
+	case "", filterModeSinglePass, filterModeHeadersFirst:
+		return nil
+	}
+	return fmt.Errorf("invalid filter mode: %s", s.FilterMode)
+}
+
+// headersFirst reports whether the filters are evaluated on the headers
+// before the complete messages are fetched.
+func (s *fetchSource) headersFirst() bool {
+	return s.FilterMode == filterModeHeadersFirst
+}
+
+// fetchHeaders fetches only the headers of the messages and returns the
+// UIDs of those passing the flags, date range, size limit and filters, so
+// that only their complete messages need to be fetched.
+func (s *fetchSource) fetchHeaders(seqset *imap.SeqSet,
+	fetch func(*imap.SeqSet, []imap.FetchItem, chan *imap.Message) error) (*imap.SeqSet, error) {
+	section, err := imap.ParseBodySectionName("BODY.PEEK[HEADER]")
+	if err != nil {
+		return nil, err
+	}
+	items := []imap.FetchItem{"UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", section.FetchItem()}
+
+	headers := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- fetch(seqset, items, headers)
+	}()
+
+	selected := new(imap.SeqSet)
+	for msg := range headers {
+		if s.selectHeaders(msg, section) {
+			selected.AddNum(msg.Uid)
+		} else {
+			s.config.log().Debugf("Not fetching message: %d", msg.Uid)
+		}
+	}
+	return selected, <-done
+}
+
+func (s *fetchSource) selectHeaders(msg *imap.Message, section *imap.BodySectionName) bool {
+	if hasFlag(msg.Flags, imap.DeletedFlag) {
+		return false
+	}
+	// Messages stored by an earlier cycle are cleaned regardless of the filters.
+	if s.checkpointed(msg.Uid) {
+		return true
+	}
+	if !s.forwardFlags(msg.Flags) {
+		return false
+	}
+	if !s.inWindow(msg.InternalDate) || s.oversized(msg.Size) {
+		return false
+	}
+	// Messages with missing or invalid headers are left to the complete
+	// fetch, which reports them.
+	header := msg.GetBody(section)
+	if header == nil {
+		return true
+	}
+	data, err := io.ReadAll(header)
+	if err != nil {
+		return true
+	}
+	matched, err := s.Filter.match(data)
+	return err != nil || matched
+}
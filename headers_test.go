@@ -0,0 +1,53 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Messages excluded by the filter are left on the source in both modes.
+func TestHandleFilter(t *testing.T) {
+	for _, mode := range []string{filterModeSinglePass, filterModeHeadersFirst} {
+		t.Run(mode, func(t *testing.T) {
+			source, target := newTestServer(t), newTestServer(t)
+			source.addMessages(t, "INBOX", "keep one", "drop two", "keep three", "drop four")
+			c := newTestConfig(t, source, target)
+			c.Source.FilterMode = mode
+			c.Source.Filter.Subject = "^keep"
+			c.logger.SetLevel(log.DebugLevel)
+			hook := test.NewLocal(c.logger)
+
+			err := handleOnce(t, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSubjects(t, "target", target.subjects(t, "INBOX"), "keep one", "keep three")
+			assertSubjects(t, "source", source.subjects(t, "INBOX"), "drop two", "drop four")
+			// Only the headers of excluded messages are fetched.
+			if skipped := logged(hook, "Not fetching message: 2"); skipped != (mode == filterModeHeadersFirst) {
+				t.Errorf("message 2 not fetched: got %v", skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// runPostHook runs the configured command after messages were forwarded,
+// a failing command is logged but does not fail the account.
+func (t *fetchTarget) runPostHook(count uint64) {
+	if len(t.PostHook) < 1 || count < 1 {
+		return
+	}
+
+	cmd := exec.CommandContext(t.config.ctx, t.PostHook[0], t.PostHook[1:]...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("GETMAIL_ACCOUNT=%s", t.config.Name),
+		fmt.Sprintf("GETMAIL_COUNT=%d", count))
+	output, err := cmd.CombinedOutput()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		t.config.log().Warnf("Post hook exited with code %d: %s", exitErr.ExitCode(), output)
+	} else if err != nil {
+		t.config.log().Warnf("Post hook failed: %v", err)
+	} else {
+		t.config.log().Debugf("Post hook finished: %s", output)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+
+	imap "github.com/emersion/go-imap"
+	client "github.com/emersion/go-imap/client"
+)
+
+// idCommand is an ID command, as defined in RFC 2971.
+type idCommand struct {
+	Fields map[string]string
+}
+
+func (cmd *idCommand) Command() *imap.Command {
+	keys := make([]string, 0, len(cmd.Fields))
+	for k := range cmd.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make([]interface{}, 0, 2*len(keys))
+	for _, k := range keys {
+		fields = append(fields, k, cmd.Fields[k])
+	}
+	return &imap.Command{
+		Name:      "ID",
+		Arguments: []interface{}{fields},
+	}
+}
+
+// sendID identifies the client if configured and supported by the server.
+func (s *FetchServer) sendID(con *client.Client) error {
+	if len(s.ClientID) < 1 {
+		return nil
+	}
+	ok, err := con.Support("ID")
+	if err != nil || !ok {
+		return err
+	}
+
+	status, err := con.Execute(&idCommand{Fields: s.ClientID}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
@@ -19,40 +19,134 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 
 	imap "github.com/emersion/go-imap"
 	idle "github.com/emersion/go-imap-idle"
 	client "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // FetchServer contains the IMAP credentials.
 type FetchServer struct {
-	Server   string
-	Username string
-	Password string
-	Mailbox  string
+	Server         string
+	Port           int
+	ConnectAddress string
+	Username       string
+	Password       string
+	Mailbox        string
+	Timeout        time.Duration
+	Proxy          string
+	Compress       bool
+	TLS            fetchTLS
+	ClientID       map[string]string
 
-	config   *fetchConfig
-	imapconn *client.Client
+	config      *fetchConfig
+	imapconn    *client.Client
+	netconn     net.Conn
+	mirrored    string
+	uidValidity uint32
+	connections int64
 }
 
 type fetchSource struct {
 	FetchServer `mapstructure:"IMAP"`
 
-	idleconn *client.Client
-	idle     *idle.Client
-	updates  chan client.Update
+	MailboxPattern string
+	RelistInterval time.Duration
+	Notify         bool
+	Keepalive      time.Duration
+	CheckpointFile string
+	Since          string
+	MinAge         time.Duration
+	MaxAge         time.Duration
+	MaxMessageSize uint32
+	MaxPerCycle    int
+	MinSize        uint32
+	MaxSize        uint32
+	FilterMode     string
+	SkipFlags      []string
+	RequireFlags   []string
+	Action         string
+	MoveMailbox    string
+	ConfirmMailbox string
+	MarkFlag       string
+	Expunge        string
+	DeleteMode     string
+	Filter         fetchFilter
+
+	idleconn   *client.Client
+	idleconns  int64
+	idle       *idle.Client
+	cleaner    *fetchSource
+	delimiter  string
+	updates    chan client.Update
+	checkpoint *fetchCheckpoint
+	modSeq     modSeqState
+	nextModSeq modSeqState
+	truncated  bool
+	resumeUid  uint32
+
+	// notifications receives the status of the mailbox if the mailboxes
+	// matching the pattern are watched with NOTIFY instead of IDLE.
+	notifications chan *imap.MailboxStatus
 }
 
 type fetchTarget struct {
 	FetchServer `mapstructure:"IMAP"`
+
+	AppendAttempts     int
+	AppendBackoff      time.Duration
+	AppendTimeout      time.Duration
+	AppendConcurrency  int
+	Flags              string
+	AllowFlags         []string
+	DenyFlags          []string
+	RateLimit          float64
+	PostHook           []string
+	CreateMailbox      bool
+	MailboxPrefix      string
+	GmailLabel         string
+	InternalDate       string
+	DateFolderTemplate string
+	Transform          fetchTransform
+
+	mailbox string
+	folders map[string]bool
+	limiter *time.Ticker
+	workers []*fetchTarget
 }
 
+const (
+	defaultTimeout    = 30 * time.Second
+	minReconnectDelay = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+	defaultHandleTime = 1 * time.Hour
+	defaultBufferSize = 100
+	defaultJitter     = 0.2
+	defaultDebounce   = 300 * time.Millisecond
+)
+
+var (
+	errUidValidityChanged = errors.New("UIDVALIDITY changed")
+	errMailboxNotFound    = errors.New("mailbox does not exist")
+	errHandleTimeout      = errors.New("handling took too long")
+	errInitTimeout        = errors.New("initialization took too long")
+)
+
 type fetchState int
 
 const (
@@ -62,56 +156,215 @@ const (
 	watchingState   = (fetchState)(1 << 2)
 	handlingState   = (fetchState)(1 << 3)
 	shutdownState   = (fetchState)(1 << 4)
+	disabledState   = (fetchState)(1 << 5)
+	overQuotaState  = (fetchState)(1 << 6)
 )
 
+// up reports whether the account is connected and watching for messages.
+func (s fetchState) up() bool {
+	switch s {
+	case connectedState, watchingState, handlingState:
+		return true
+	}
+	return false
+}
+
+// fetchTargets can be configured as a single target or a list of targets.
+type fetchTargets []*fetchTarget
+
+type fetchPipeline struct {
+	MessageBuffer int
+	DeleteBuffer  int
+}
+
+// fetchSettings are the settings of an account which also apply to the
+// accounts forwarding the mailboxes matching its pattern.
+type fetchSettings struct {
+	Enabled         *bool
+	LogLevel        string
+	HandleTimeout   time.Duration
+	InitTimeout     time.Duration
+	LogoutTimeout   time.Duration
+	ReconnectJitter *float64
+	UpdateDebounce  *time.Duration
+	Pipeline        fetchPipeline
+}
+
 type fetchConfig struct {
+	fetchSettings `mapstructure:",squash"`
+
 	Name   string
 	Source fetchSource
-	Target fetchTarget
+	Target fetchTargets
+
+	state         fetchState
+	total         uint64
+	totalBytes    uint64
+	failures      uint64
+	lastErr       error
+	lastState     fetchState
+	initDeadline  time.Time
+	overQuota     int32
+	compressSaved int64
+	watchdogTrips uint64
+	emptyCycles   uint64
+	lastUpdate    int64
+	handles       chan struct{}
+	ctx           context.Context
+	logger        *log.Logger
+	mailboxes     map[string]*fetchConfig
+	notifier      *fetchConfig
+	mailboxLock   sync.Mutex
+}
+
+// mailboxName returns the mailbox to select, which is derived from the
+// source mailbox if the target mirrors it.
+func (s *FetchServer) mailboxName() string {
+	if s.mirrored != "" {
+		return s.mirrored
+	}
+	return s.Mailbox
+}
 
-	state fetchState
-	total uint64
-	ctx   context.Context
+func (s *FetchServer) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.config.boundedTimeout(s.Timeout)
+	}
+	return s.config.boundedTimeout(defaultTimeout)
 }
 
-func (s *FetchServer) open() (*client.Client, error) {
-	con, err := client.DialTLS(s.Server, nil)
+func (s *FetchServer) open() (*client.Client, net.Conn, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	var deflate *deflateConn
+	if s.Compress {
+		deflate = newDeflateConn(conn, &s.config.compressSaved)
+		conn = deflate
+	}
+	con, err := client.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	con.Timeout = s.timeout()
+	err = s.login(con)
 	if err != nil {
-		return nil, err
+		con.Logout()
+		return nil, nil, err
 	}
-	err = con.Login(s.Username, s.Password)
+	err = s.sendID(con)
 	if err != nil {
-		return nil, err
+		con.Logout()
+		return nil, nil, err
+	}
+	if deflate != nil {
+		err = s.compress(con, deflate)
+		if err != nil {
+			con.Logout()
+			return nil, nil, err
+		}
 	}
-	return con, nil
+	return con, conn, nil
 }
 
 func (s *FetchServer) openIMAP() error {
-	con, err := s.open()
+	con, conn, err := s.open()
 	if err != nil {
 		return err
 	}
 	s.imapconn = con
+	s.netconn = conn
+	atomic.AddInt64(&s.connections, 1)
 	return nil
 }
 
 func (s *fetchSource) openIDLE() error {
-	con, err := s.open()
+	con, _, err := s.open()
 	if err != nil {
 		return err
 	}
 	s.idleconn = con
+	atomic.AddInt64(&s.idleconns, 1)
 	return nil
 }
 
+func mailboxExists(con *client.Client, name string) (bool, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- con.List("", name, mailboxes)
+	}()
+	exists := false
+	for range mailboxes {
+		exists = true
+	}
+	return exists, <-done
+}
+
+func (s *FetchServer) selectMailbox(con *client.Client, readOnly bool) (*imap.MailboxStatus, error) {
+	status, err := con.Select(s.mailboxName(), readOnly)
+	if err != nil {
+		exists, lerr := mailboxExists(con, s.mailboxName())
+		if lerr == nil && !exists {
+			return nil, fmt.Errorf("%w: %s on %s, please check the configured mailbox name",
+				errMailboxNotFound, s.mailboxName(), s.Server)
+		}
+	}
+	return status, err
+}
+
 func (s *FetchServer) selectIMAP() (*client.MailboxUpdate, error) {
-	status, err := s.imapconn.Select(s.Mailbox, false)
+	status, err := s.selectMailbox(s.imapconn, false)
+	if err == nil {
+		s.uidValidity = status.UidValidity
+	}
 	update := &client.MailboxUpdate{Mailbox: status}
 	return update, err
 }
 
+// checkMailbox verifies that the source mailbox can be selected.
+func (s *fetchSource) checkMailbox() error {
+	_, err := s.selectMailbox(s.imapconn, true)
+	if err != nil {
+		return fmt.Errorf("source mailbox %s on %s: %w", s.Mailbox, s.Server, err)
+	}
+	return nil
+}
+
+// checkMailbox verifies that the target mailbox is accessible, unless it
+// does not exist yet and is going to be created.
+func (t *fetchTarget) checkMailbox() error {
+	_, err := t.imapconn.Status(t.mailboxName(), []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		if t.createMailboxes() {
+			exists, lerr := mailboxExists(t.imapconn, t.mailboxName())
+			if lerr == nil && !exists {
+				return nil
+			}
+		}
+		return fmt.Errorf("target mailbox %s on %s: %w", t.mailboxName(), t.Server, err)
+	}
+	return nil
+}
+
+func (s *FetchServer) checkUidValidity() error {
+	uidValidity := s.uidValidity
+	update, err := s.selectIMAP()
+	if err != nil {
+		return err
+	}
+	if update.Mailbox.UidValidity != uidValidity {
+		s.config.log().Warnf("UIDVALIDITY of %s changed from %d to %d, aborting",
+			s.Mailbox, uidValidity, update.Mailbox.UidValidity)
+		return errUidValidityChanged
+	}
+	return nil
+}
+
 func (s *fetchSource) selectIDLE() (*client.MailboxUpdate, error) {
-	status, err := s.idleconn.Select(s.Mailbox, true)
+	status, err := s.selectMailbox(s.idleconn, true)
 	update := &client.MailboxUpdate{Mailbox: status}
 	return update, err
 }
@@ -124,39 +377,67 @@ func (s *fetchSource) initIDLE() error {
 	updates := make(chan client.Update, 1)
 	updates <- update
 
+	// IDLE runs until it is stopped, so it must not be bound by the command timeout.
+	s.idleconn.Timeout = 0
 	s.idle = idle.NewClient(s.idleconn)
 	s.idleconn.Updates = updates
 	s.updates = updates
 	return nil
 }
 
-func (c *fetchConfig) init() error {
+func (c *fetchConfig) bind() {
 	c.Source.config = c
-	c.Target.config = c
+	for _, t := range c.Target {
+		t.config = c
+	}
+}
+
+func (c *fetchConfig) init() error {
+	c.bind()
 	c.state = connectingState
 	err := c.Source.openIMAP()
 	if err != nil {
 		return err
 	}
-	err = c.Source.closeIMAP()
+	err = c.Source.checkMailbox()
 	if err != nil {
 		return err
 	}
-	err = c.Target.openIMAP()
+	err = c.listDelimiter()
 	if err != nil {
 		return err
 	}
-	err = c.Target.closeIMAP()
+	err = c.Source.closeIMAP()
 	if err != nil {
 		return err
 	}
-	err = c.Source.openIDLE()
-	if err != nil {
-		return err
+	for _, t := range c.Target {
+		err = t.openIMAP()
+		if err != nil {
+			return err
+		}
+		err = t.bindMailbox(&c.Source)
+		if err != nil {
+			return err
+		}
+		err = t.checkMailbox()
+		if err != nil {
+			return err
+		}
+		err = t.closeIMAP()
+		if err != nil {
+			return err
+		}
 	}
-	err = c.Source.initIDLE()
-	if err != nil {
-		return err
+	if c.Source.notifications == nil {
+		err = c.Source.openIDLE()
+		if err != nil {
+			return err
+		}
+		err = c.Source.initIDLE()
+		if err != nil {
+			return err
+		}
 	}
 	c.state = connectedState
 	return err
@@ -166,41 +447,38 @@ func (s *FetchServer) closeIMAP() error {
 	if s.imapconn == nil {
 		return nil
 	}
-	err := s.imapconn.Logout()
-	if err != nil {
-		return err
-	}
+	err := s.logout(s.imapconn)
 	s.imapconn = nil
-	return nil
+	s.netconn = nil
+	atomic.AddInt64(&s.connections, -1)
+	return err
 }
 
 func (s *fetchSource) closeIDLE() error {
 	if s.idleconn == nil {
 		return nil
 	}
-	err := s.idleconn.Logout()
-	if err != nil {
-		return err
-	}
+	err := s.logout(s.idleconn)
 	s.idleconn = nil
-	return nil
+	atomic.AddInt64(&s.idleconns, -1)
+	return err
 }
 
 func (c *fetchConfig) close() error {
+	c.lastState = c.state
 	c.state = shutdownState
-	err := c.Source.closeIDLE()
-	if err != nil {
-		return err
-	}
-	err = c.Source.closeIMAP()
-	if err != nil {
-		return err
-	}
-	err = c.Target.closeIMAP()
-	if err != nil {
-		return err
+	errIDLE := c.Source.closeIDLE()
+	errSource := c.Source.closeIMAP()
+	errs := []error{errIDLE, errSource}
+	for _, t := range c.Target {
+		errs = append(errs, t.closeIMAP())
 	}
 	c.state = initialState
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -212,24 +490,69 @@ func (c *fetchConfig) watch() error {
 
 	c.log().Info("Begin idling")
 
-	ctx, cancel := context.WithCancel(c.ctx)
-	defer cancel()
-
 	errors := make(chan error, 1)
-	go func() {
-		errors <- c.Source.idle.IdleWithFallback(ctx.Done(), 0)
+	stopIdle := c.Source.startIdle(c.ctx, errors)
+	defer func() {
+		stopIdle()
 	}()
+
+	var keepalive <-chan time.Time
+	if ticker := c.Source.keepaliveTicker(); ticker != nil {
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	// Bursts of updates are collected and handled at once.
+	var debounce <-chan time.Time
+	// Only an increasing number of messages means new mail, the number
+	// also drops when messages are expunged by this or another client.
+	known := uint32(0)
 	for {
 		select {
 		case update := <-c.Source.updates:
-			c.log().Infof("New update: %#v", update)
-			_, ok := update.(*client.MailboxUpdate)
-			if ok {
-				err := c.handle()
-				if err != nil {
-					return err
+			atomic.StoreInt64(&c.lastUpdate, time.Now().Unix())
+			switch update := update.(type) {
+			case *client.MailboxUpdate:
+				messages := update.Mailbox.Messages
+				if messages <= known {
+					c.log().Debugf("Mailbox update without new messages: %d", messages)
+					known = messages
+					continue
 				}
+				c.log().Infof("New messages: %d", messages-known)
+				known = messages
+			case *client.ExpungeUpdate:
+				c.log().Debugf("Message expunged: %d", update.SeqNum)
+				if known > 0 {
+					known--
+				}
+				continue
+			default:
+				c.log().Debugf("New update: %#v", update)
+				continue
+			}
+			if window := c.debounce(); window > 0 {
+				if debounce == nil {
+					debounce = time.After(window)
+				}
+				continue
 			}
+			err := c.handleAll()
+			if err != nil {
+				return err
+			}
+		case <-debounce:
+			debounce = nil
+			err := c.handleAll()
+			if err != nil {
+				return err
+			}
+		case <-keepalive:
+			err := c.Source.keepalive(stopIdle, errors)
+			if err != nil {
+				c.log().Warnf("Keepalive failed: %v", err)
+				return err
+			}
+			stopIdle = c.Source.startIdle(c.ctx, errors)
 		case err := <-errors:
 			c.log().Warnf("Not idling anymore: %v", err)
 			return err
@@ -237,7 +560,38 @@ func (c *fetchConfig) watch() error {
 	}
 }
 
+// acquireHandle waits for a free handling slot if their number is limited.
+func (c *fetchConfig) acquireHandle() error {
+	if c.handles == nil {
+		return nil
+	}
+	select {
+	case c.handles <- struct{}{}:
+		return nil
+	default:
+	}
+	c.log().Info("Waiting for a free handling slot")
+	select {
+	case c.handles <- struct{}{}:
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+func (c *fetchConfig) releaseHandle() {
+	if c.handles != nil {
+		<-c.handles
+	}
+}
+
 func (c *fetchConfig) handle() error {
+	err := c.acquireHandle()
+	if err != nil {
+		return err
+	}
+	defer c.releaseHandle()
+
 	defer func(c *fetchConfig, s fetchState) {
 		c.state = s
 	}(c, c.state)
@@ -245,125 +599,606 @@ func (c *fetchConfig) handle() error {
 
 	c.log().Info("Begin handling")
 
-	err := c.Source.openIMAP()
+	err = c.Source.openIMAP()
 	if err != nil {
 		c.log().Warnf("Source connection failed: %v", err)
 		return err
 	}
 	defer c.Source.closeIMAP()
 
-	err = c.Target.openIMAP()
+	err = c.Source.openCleaner()
+	defer c.Source.closeCleaner()
+	if err != nil {
+		c.log().Warnf("Source connection failed: %v", err)
+		return err
+	}
+
+	err = c.listDelimiter()
 	if err != nil {
-		c.log().Warnf("Target connection failed: %v", err)
+		c.log().Warnf("Listing source mailbox failed: %v", err)
 		return err
 	}
-	defer c.Target.closeIMAP()
 
-	messages := make(chan *imap.Message, 100)
-	deletes := make(chan uint32, 100)
+	for _, t := range c.Target {
+		err = t.openIMAP()
+		if err != nil {
+			c.log().Warnf("Target connection failed: %v", err)
+			return err
+		}
+		defer t.closeIMAP()
+
+		err = t.bindMailbox(&c.Source)
+		if err != nil {
+			c.log().Warnf("Listing target mailbox failed: %v", err)
+			return err
+		}
+
+		err = t.openWorkers()
+		defer t.closeWorkers()
+		if err != nil {
+			c.log().Warnf("Target connection failed: %v", err)
+			return err
+		}
+	}
+
+	// The stages wait for each other, so handling is bounded by the
+	// watchdog instead of the timeout of each command.
+	for _, s := range c.handleServers() {
+		err = s.clearTimeout()
+		if err != nil {
+			return err
+		}
+	}
+
+	total := c.total
 
-	var g errgroup.Group
+	watchdog := c.startWatchdog()
+
+	messages := make(chan *imap.Message, c.Pipeline.messageBuffer())
+	deletes := make(chan uint32, c.Pipeline.deleteBuffer())
+
+	// go-imap does not support contexts, so terminate the connections to
+	// interrupt commands in flight when the account is shut down.
+	conns := c.handleConns()
+	stop := context.AfterFunc(c.ctx, func() {
+		for _, con := range conns {
+			con.Terminate()
+		}
+	})
+	defer stop()
+
+	g, ctx := errgroup.WithContext(c.ctx)
 	g.Go(func() error {
-		return c.Source.fetchMessages(messages)
+		defer trackGoroutine(&handleGoroutines)()
+		return stageError("fetch", c.Source.fetchMessages(messages))
 	})
 	g.Go(func() error {
-		return c.Target.storeMessages(messages, deletes)
+		defer trackGoroutine(&handleGoroutines)()
+		return stageError("store", c.storeMessages(ctx, messages, deletes))
 	})
 	g.Go(func() error {
-		return c.Source.cleanMessages(deletes)
+		defer trackGoroutine(&handleGoroutines)()
+		return stageError("clean", c.Source.cleanMessages(deletes))
 	})
 
 	err = g.Wait()
+	tripped := !watchdog.Stop()
 	if err != nil {
+		if tripped {
+			err = fmt.Errorf("%w: %v", errHandleTimeout, err)
+		}
+		if errors.Is(err, errOverQuota) {
+			c.log().Debugf("Message handling failed: %v", err)
+			return err
+		}
 		c.log().Warnf("Message handling failed: %v", err)
 		return err
 	}
 
-	err = c.Source.imapconn.Expunge(nil)
-	if err != nil {
-		c.log().Warnf("Message expunge failed: %v", err)
-		return err
+	// Messages left for the next cycle may not have changed since.
+	if !c.Source.truncated {
+		c.Source.commitModSeq()
+	}
+	for _, t := range c.Target {
+		t.runPostHook(c.total - total)
 	}
 
 	c.log().Info("Message handling finished")
 	return nil
 }
 
+// stageError prefixes an error with the pipeline stage it occurred in.
+func stageError(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", stage, err)
+}
+
+func (p *fetchPipeline) messageBuffer() int {
+	if p.MessageBuffer > 0 {
+		return p.MessageBuffer
+	}
+	return defaultBufferSize
+}
+
+func (p *fetchPipeline) deleteBuffer() int {
+	if p.DeleteBuffer > 0 {
+		return p.DeleteBuffer
+	}
+	return defaultBufferSize
+}
+
+// validate rejects negative buffer sizes, zero selects the default.
+func (p *fetchPipeline) validate() error {
+	if p.MessageBuffer < 0 || p.DeleteBuffer < 0 {
+		return errors.New("pipeline buffer sizes must be positive")
+	}
+	return nil
+}
+
+func (c *fetchConfig) handleTimeout() time.Duration {
+	if c.HandleTimeout > 0 {
+		return c.HandleTimeout
+	}
+	return defaultHandleTime
+}
+
+// handleServers returns the servers whose connections are used for
+// handling messages.
+func (c *fetchConfig) handleServers() []*FetchServer {
+	servers := []*FetchServer{&c.Source.FetchServer}
+	if c.Source.cleaner != nil {
+		servers = append(servers, &c.Source.cleaner.FetchServer)
+	}
+	for _, t := range c.Target {
+		for _, w := range t.appenders() {
+			servers = append(servers, &w.FetchServer)
+		}
+	}
+	return servers
+}
+
+// handleConns returns the connections used for handling messages.
+func (c *fetchConfig) handleConns() []*client.Client {
+	conns := []*client.Client{}
+	for _, s := range c.handleServers() {
+		conns = append(conns, s.imapconn)
+	}
+	return conns
+}
+
+// clearTimeout lifts the command timeout and the deadline left behind by
+// the last command. go-imap never clears the deadline after a command, so
+// a connection waiting on another pipeline stage would be closed by it.
+func (s *FetchServer) clearTimeout() error {
+	s.imapconn.Timeout = 0
+	return s.netconn.SetDeadline(time.Time{})
+}
+
+// startWatchdog terminates the handling connections if handling does not
+// finish in time, so that a stalled server cannot block the account forever.
+func (c *fetchConfig) startWatchdog() *time.Timer {
+	conns := c.handleConns()
+	return time.AfterFunc(c.handleTimeout(), func() {
+		atomic.AddUint64(&c.watchdogTrips, 1)
+		c.log().Warnf("Handling did not finish within %s, terminating connections", c.handleTimeout())
+		for _, con := range conns {
+			con.Terminate()
+		}
+	})
+}
+
 func (s *fetchSource) fetchMessages(messages chan *imap.Message) error {
+	s.truncated = false
+
+	modSeq, err := s.statusModSeq()
+	if err != nil {
+		close(messages)
+		return err
+	}
+
 	update, err := s.selectIMAP()
 	if err != nil {
 		close(messages)
 		return err
 	}
 
+	// Messages skipped for being too young do not change once they are
+	// old enough, so they would never be fetched again incrementally.
+	changedSince := uint64(0)
+	if s.modSeq.UidValidity == update.Mailbox.UidValidity && s.MinAge <= 0 {
+		changedSince = s.modSeq.ModSeq
+	}
+	s.nextModSeq = modSeqState{UidValidity: update.Mailbox.UidValidity, ModSeq: modSeq}
+
 	if update.Mailbox.Messages < 1 {
+		s.config.log().Info("Mailbox is empty")
+		atomic.AddUint64(&s.config.emptyCycles, 1)
 		close(messages)
 		return nil
 	}
 
+	err = s.loadCheckpoint(update.Mailbox.UidValidity)
+	if err != nil {
+		close(messages)
+		return err
+	}
+
+	criteria, err := s.searchCriteria()
+	if err != nil {
+		close(messages)
+		return err
+	}
+	// Fetch by UID so that the whole pipeline works on UIDs.
+	nextUid := max(s.resumeUid, s.nextUid())
+	criteria = s.actionCriteria(criteria, nextUid)
+	uids, err := s.imapconn.UidSearch(criteria)
+	if err != nil {
+		close(messages)
+		return err
+	}
+	next := []uint32{}
+	for _, uid := range uids {
+		if uid >= nextUid {
+			next = append(next, uid)
+		}
+	}
 	seqset := new(imap.SeqSet)
-	seqset.AddRange(1, update.Mailbox.Messages)
+	seqset.AddNum(s.limitCycle(next)...)
+	if seqset.Empty() {
+		s.config.log().Info("No messages matched the search criteria")
+		close(messages)
+		return nil
+	}
 
-	return s.imapconn.Fetch(seqset, []imap.FetchItem{
-		"UID", "FLAGS", "INTERNALDATE", "BODY[]"}, messages)
+	items := []imap.FetchItem{"UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "BODY[]"}
+
+	fetch := func(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+		return s.imapconn.UidFetch(seqset, items, ch)
+	}
+	if changedSince > 0 && modSeq > 0 {
+		if modSeq == changedSince {
+			s.config.log().Debugf("Mailbox unchanged since MODSEQ %d", changedSince)
+			close(messages)
+			return nil
+		}
+		s.config.log().Debugf("Fetching changes since MODSEQ %d", changedSince)
+		fetch = func(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+			return s.uidFetchChangedSince(seqset, items, changedSince, ch)
+		}
+	}
+
+	if s.headersFirst() {
+		seqset, err = s.fetchHeaders(seqset, fetch)
+		if err != nil || seqset.Empty() {
+			close(messages)
+			return err
+		}
+		fetch = s.imapconn.UidFetch
+	}
+
+	return fetch(seqset, items, messages)
 }
 
-func (t *fetchTarget) storeMessages(messages <-chan *imap.Message, deletes chan<- uint32) error {
+func (c *fetchConfig) storeMessages(ctx context.Context, messages <-chan *imap.Message, deletes chan<- uint32) error {
 	defer close(deletes)
 
-	section, err := imap.ParseBodySectionName("BODY[]")
-	if err != nil {
-		return err
+	// Drain remaining messages on early return, otherwise fetching blocks forever.
+	defer func() {
+		for range messages {
+		}
+	}()
+
+	for _, t := range c.Target {
+		err := t.prepareStore()
+		defer t.finishStore()
+		if err != nil {
+			return err
+		}
 	}
 
-	update, err := t.selectIMAP()
+	// The message stays on the source unless all targets stored it,
+	// so that the next run retries all of them.
+	tracker := newStoreTracker()
+	jobs := make([]chan *storeJob, len(c.Target))
+	g, ctx := errgroup.WithContext(ctx)
+	for i, t := range c.Target {
+		jobs[i] = make(chan *storeJob)
+		for _, w := range t.appenders() {
+			g.Go(func() error {
+				defer trackGoroutine(&handleGoroutines)()
+				return c.appendMessages(w, jobs[i], tracker, deletes)
+			})
+		}
+	}
+	g.Go(func() error {
+		defer trackGoroutine(&handleGoroutines)()
+		defer func() {
+			for _, ch := range jobs {
+				close(ch)
+			}
+		}()
+		return c.filterMessages(ctx, messages, jobs, tracker, deletes)
+	})
+	err := g.Wait()
+	return errors.Join(err, c.Source.advanceCheckpoint(tracker.lowestPending()))
+}
+
+// filterMessages passes the messages to be forwarded on to the targets.
+func (c *fetchConfig) filterMessages(ctx context.Context, messages <-chan *imap.Message, jobs []chan *storeJob, tracker *storeTracker, deletes chan<- uint32) error {
+	section, err := imap.ParseBodySectionName("BODY[]")
 	if err != nil {
 		return err
 	}
 
+	matches, unmatched := 0, 0
 	for msg := range messages {
-		t.config.log().Infof("Handling message: %d", msg.Uid)
-
-		deleted := false
-		flags := []string{}
-		for _, flag := range msg.Flags {
-			switch flag {
-			case imap.DeletedFlag:
-				deleted = true
-				break
-			case imap.RecentFlag:
-				continue
-			case imap.SeenFlag:
-				continue
-			default:
-				flags = append(flags, flag)
-			}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		c.log().Infof("Handling message: %d", msg.Uid)
+
+		if hasFlag(msg.Flags, imap.DeletedFlag) {
+			c.log().Infof("Ignoring message: %d", msg.Uid)
+			continue
+		}
+
+		// Only messages stored by an earlier cycle are cleaned right away,
+		// even if they would be skipped now.
+		if c.Source.checkpointed(msg.Uid) {
+			c.log().Infof("Message already stored: %d", msg.Uid)
+			deletes <- msg.Uid
+			continue
+		}
+
+		if !c.Source.forwardFlags(msg.Flags) {
+			c.log().Infof("Skipping message due to its flags: %d", msg.Uid)
+			continue
 		}
-		if deleted {
-			t.config.log().Infof("Ignoring message: %d", msg.Uid)
+
+		if !c.Source.inWindow(msg.InternalDate) {
+			c.log().Infof("Skipping message outside of date range: %d", msg.Uid)
 			continue
 		}
 
-		t.config.log().Infof("Storing message: %d", msg.Uid)
+		if c.Source.oversized(msg.Size) {
+			c.log().Warnf("Skipping message larger than %d bytes: %d (%d bytes)",
+				c.Source.MaxMessageSize, msg.Uid, msg.Size)
+			continue
+		}
 
+		// Leave unreadable messages on the source instead of aborting the batch.
 		body := msg.GetBody(section)
-		err := t.imapconn.Append(update.Mailbox.Name, flags, msg.InternalDate, body)
+		if body == nil {
+			c.log().Warnf("Skipping message without body: %d", msg.Uid)
+			continue
+		}
+		data, err := io.ReadAll(body)
 		if err != nil {
 			return err
 		}
+		if len(data) == 0 {
+			c.log().Warnf("Skipping message with empty body: %d", msg.Uid)
+			continue
+		}
 
-		t.config.total++
-		deletes <- msg.Uid
+		matched, err := c.Source.Filter.match(data)
+		if err != nil {
+			c.log().Warnf("Skipping message with invalid header: %d: %v", msg.Uid, err)
+			continue
+		}
+		if !matched {
+			c.log().Infof("Skipping message not matching filter: %d", msg.Uid)
+			unmatched++
+			continue
+		}
+		matches++
+
+		tracker.add(msg.Uid, len(jobs))
+		job := &storeJob{msg: msg, data: data}
+		for _, ch := range jobs {
+			select {
+			case ch <- job:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
 	}
 
+	if unmatched > 0 && matches == 0 {
+		c.log().Infof("No messages matched the filter, %d skipped", unmatched)
+	}
 	return nil
 }
 
+// prepareStore selects the target mailbox, creating it if configured.
+func (t *fetchTarget) prepareStore() error {
+	if t.createMailboxes() {
+		err := t.createMailbox(t.mailboxName())
+		if err != nil {
+			return err
+		}
+	}
+
+	update, err := t.selectIMAP()
+	if err != nil {
+		return err
+	}
+	t.mailbox = update.Mailbox.Name
+	t.folders = map[string]bool{}
+
+	if interval := t.appendInterval(); interval > 0 {
+		t.limiter = time.NewTicker(interval)
+	}
+	return t.prepareWorkers()
+}
+
+func (t *fetchTarget) finishStore() {
+	if t.limiter != nil {
+		t.limiter.Stop()
+		t.limiter = nil
+	}
+}
+
+func (t *fetchTarget) storeMessage(msg *imap.Message, data []byte) error {
+	flags := []string{}
+	for _, flag := range msg.Flags {
+		if flag != imap.RecentFlag && t.keepFlag(flag) {
+			flags = append(flags, flag)
+		}
+	}
+
+	if t.limiter != nil {
+		select {
+		case <-t.limiter.C:
+		case <-t.config.ctx.Done():
+			return t.config.ctx.Err()
+		}
+	}
+
+	t.config.log().Infof("Storing message on %s: %d", t.Server, msg.Uid)
+
+	date := t.internalDate(msg.InternalDate, data)
+
+	transformed, err := t.Transform.apply(data)
+	if err != nil {
+		if !t.Transform.StoreUntransformed {
+			return fmt.Errorf("transforming message %d: %w", msg.Uid, err)
+		}
+		t.config.log().Warnf("Storing message without transformation: %d: %v", msg.Uid, err)
+		transformed = data
+	}
+
+	mailbox, err := t.dateFolder(msg.InternalDate)
+	if err != nil {
+		return err
+	}
+
+	uid, err := t.appendMessage(mailbox, flags, date, transformed)
+	if err != nil {
+		return err
+	}
+
+	// The message is stored already, failing it would append it again.
+	err = t.labelMessage(uid)
+	if err != nil {
+		t.config.log().Warnf("Labeling message on %s failed: %d: %v", t.Server, msg.Uid, err)
+	}
+	return nil
+}
+
+// oversized reports whether a message exceeds the configured size limit.
+func (s *fetchSource) oversized(size uint32) bool {
+	return s.MaxMessageSize > 0 && size > s.MaxMessageSize
+}
+
+// createMailbox creates and subscribes to the mailbox unless it already exists.
+func (t *fetchTarget) createMailbox(name string) error {
+	err := t.imapconn.Create(name)
+	if err != nil {
+		exists, lerr := mailboxExists(t.imapconn, name)
+		if lerr != nil || !exists {
+			return err
+		}
+		return nil
+	}
+	t.config.log().Infof("Created mailbox: %s", name)
+	return t.imapconn.Subscribe(name)
+}
+
+func (t *fetchTarget) appendInterval() time.Duration {
+	if t.RateLimit <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / t.RateLimit)
+}
+
+// appendMessage appends the message with retries and returns its UID on
+// the target, or 0 if the server does not report it.
+func (t *fetchTarget) appendMessage(mailbox string, flags []string, date time.Time, data []byte) (uint32, error) {
+	attempts := t.AppendAttempts
+	if attempts < 1 {
+		attempts = 3
+	}
+	backoff := t.AppendBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		uid, err := t.timedAppend(mailbox, flags, date, data)
+		if err == nil {
+			t.config.resumeQuota()
+			return uid, nil
+		}
+		// Retrying immediately does not help a target over its quota.
+		if attempt >= attempts || errors.Is(err, errOverQuota) {
+			return uid, err
+		}
+
+		t.config.log().Warnf("Append attempt %d of %d failed, retrying in %s: %v",
+			attempt, attempts, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-t.config.ctx.Done():
+			return 0, t.config.ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// timedAppend limits appending to AppendTimeout, since uploading large
+// messages may take longer than any other command.
+func (t *fetchTarget) timedAppend(mailbox string, flags []string, date time.Time, data []byte) (uint32, error) {
+	if t.AppendTimeout <= 0 {
+		return t.append(mailbox, flags, date, data)
+	}
+	t.imapconn.Timeout = t.AppendTimeout
+	uid, err := t.append(mailbox, flags, date, data)
+	return uid, errors.Join(err, t.clearTimeout())
+}
+
+// append is like client.Append, but reads the UID from the APPENDUID
+// response code defined in RFC 4315.
+func (t *fetchTarget) append(mailbox string, flags []string, date time.Time, data []byte) (uint32, error) {
+	cmd := &commands.Append{
+		Mailbox: mailbox,
+		Flags:   flags,
+		Date:    date,
+		Message: bytes.NewReader(data),
+	}
+	status, err := t.imapconn.Execute(cmd, nil)
+	if err != nil {
+		return 0, err
+	}
+	err = quotaError(status)
+	if err != nil {
+		return 0, err
+	}
+	if status.Code != "APPENDUID" || len(status.Arguments) < 2 {
+		return 0, nil
+	}
+	uid, err := imap.ParseNumber(status.Arguments[1])
+	if err != nil {
+		return 0, nil
+	}
+	return uid, nil
+}
+
 func (s *fetchSource) cleanMessages(deletes <-chan uint32) error {
+	if s.DeleteMode == deleteModePerMessage {
+		return s.cleanEachMessage(deletes)
+	}
+
+	var uids []uint32
 	seqset := new(imap.SeqSet)
 	for uid := range deletes {
 		s.config.log().Infof("Deleting message: %d", uid)
 
+		uids = append(uids, uid)
 		seqset.AddNum(uid)
 	}
 
@@ -371,21 +1206,172 @@ func (s *fetchSource) cleanMessages(deletes <-chan uint32) error {
 		return nil
 	}
 
-	return s.imapconn.UidStore(seqset, imap.AddFlags,
-		[]interface{}{imap.DeletedFlag}, nil)
+	err := s.checkUidValidity()
+	if err != nil {
+		return err
+	}
+
+	err = s.markMessages(seqset)
+	if err != nil {
+		return err
+	}
+	return s.clearCheckpoint(uids)
 }
 
-func (c *fetchConfig) run() error {
-	err := c.init()
+// cleanEachMessage deletes each message right after it was stored, so that
+// fewer messages are forwarded twice if the process dies in the middle.
+// The messages are deleted on a separate connection, because the source
+// connection is still busy fetching them.
+func (s *fetchSource) cleanEachMessage(deletes <-chan uint32) error {
+	// Drain remaining deletes on early return, otherwise storing blocks forever.
+	defer func() {
+		for range deletes {
+		}
+	}()
+
+	cleaner := s.cleaner
+	checked := false
+	for uid := range deletes {
+		s.config.log().Infof("Deleting message: %d", uid)
+
+		if !checked {
+			cleaner.uidValidity = s.uidValidity
+			err := cleaner.checkUidValidity()
+			if err != nil {
+				return err
+			}
+			checked = true
+		}
+
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uid)
+		err := cleaner.markMessages(seqset)
+		if err != nil {
+			return err
+		}
+		err = s.clearCheckpoint([]uint32{uid})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openCleaner opens the connection deleting messages one by one, it is
+// counted as a connection of the source.
+func (s *fetchSource) openCleaner() error {
+	if s.DeleteMode != deleteModePerMessage {
+		return nil
+	}
+	w := *s
+	w.imapconn = nil
+	w.cleaner = nil
+	err := w.openIMAP()
 	if err != nil {
 		return err
 	}
+	atomic.AddInt64(&s.connections, 1)
+	s.cleaner = &w
+	return nil
+}
+
+func (s *fetchSource) closeCleaner() error {
+	if s.cleaner == nil {
+		return nil
+	}
+	err := s.cleaner.closeIMAP()
+	atomic.AddInt64(&s.connections, -1)
+	s.cleaner = nil
+	return err
+}
+
+func (c *fetchConfig) session() error {
 	defer c.close()
+	err := c.initBounded()
+	if err != nil {
+		return err
+	}
+	if c.Source.notifications != nil {
+		return c.watchNotify()
+	}
 	return c.watch()
 }
 
+func (c *fetchConfig) run() error {
+	defer trackGoroutine(&accountGoroutines)()
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := c.session()
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		atomic.AddUint64(&c.failures, 1)
+		c.lastErr = err
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+
+		wait := c.jitter(delay)
+		if errors.Is(err, errOverQuota) {
+			c.pauseOverQuota(wait, err)
+		} else {
+			c.log().Warnf("Reconnecting in %s: %v", wait, err)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return nil
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// jitter randomizes the delay, so that accounts sharing a server do not
+// all reconnect at the same time.
+func (c *fetchConfig) jitter(delay time.Duration) time.Duration {
+	fraction := defaultJitter
+	if c.ReconnectJitter != nil {
+		fraction = *c.ReconnectJitter
+	}
+	spread := float64(delay) * fraction
+	return delay + time.Duration(spread*(2*rand.Float64()-1)).Round(time.Millisecond)
+}
+
+// enabled reports whether the account is to be run, which is the default.
+func (c *fetchConfig) enabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func (c *fetchConfig) debounce() time.Duration {
+	if c.UpdateDebounce != nil {
+		return *c.UpdateDebounce
+	}
+	return defaultDebounce
+}
+
+func (c *fetchConfig) runOnce() error {
+	defer trackGoroutine(&accountGoroutines)()
+	c.bind()
+	defer c.close()
+	err := c.handleAll()
+	if err != nil {
+		atomic.AddUint64(&c.failures, 1)
+		c.lastErr = err
+	}
+	return err
+}
+
 func (c *fetchConfig) log() *log.Entry {
-	return log.WithFields(log.Fields{
+	logger := c.logger
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	return logger.WithFields(log.Fields{
 		"name":  c.Name,
 		"state": c.state,
 	})
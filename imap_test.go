@@ -0,0 +1,356 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	stdlog "log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// testServer is an in-memory IMAP server over TLS with the single user of
+// the memory backend.
+type testServer struct {
+	backend *memory.Backend
+	address string
+	caFile  string
+}
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1 and
+// the name of a PEM file containing it.
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+func newTestServer(t *testing.T) *testServer {
+	cert, caFile := newTestCertificate(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be := memory.New()
+	srv := server.New(be)
+	srv.ErrorLog = stdlog.New(io.Discard, "", 0)
+	go srv.Serve(tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	s := &testServer{backend: be, address: listener.Addr().String(), caFile: caFile}
+	s.mailbox(t, "INBOX").Messages = nil
+	return s
+}
+
+func (s *testServer) fetchServer() FetchServer {
+	return FetchServer{
+		Server:   s.address,
+		Username: "username",
+		Password: "password",
+		Mailbox:  "INBOX",
+		Timeout:  10 * time.Second,
+		TLS:      fetchTLS{CAFile: s.caFile},
+	}
+}
+
+func (s *testServer) mailbox(t *testing.T, name string) *memory.Mailbox {
+	user, err := s.backend.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mbox.(*memory.Mailbox)
+}
+
+// addMessages adds messages with the given subjects to the mailbox.
+func (s *testServer) addMessages(t *testing.T, name string, subjects ...string) {
+	mbox := s.mailbox(t, name)
+	for _, subject := range subjects {
+		body := fmt.Sprintf("From: sender@example.org\r\n"+
+			"To: recipient@example.org\r\n"+
+			"Subject: %s\r\n"+
+			"Date: Wed, 11 May 2016 14:31:59 +0000\r\n"+
+			"\r\n"+
+			"Body of %s", subject, subject)
+		err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// subjects returns the subjects of the messages in the mailbox.
+func (s *testServer) subjects(t *testing.T, name string) []string {
+	subjects := []string{}
+	for _, msg := range s.mailbox(t, name).Messages {
+		for _, line := range bytes.Split(msg.Body, []byte("\r\n")) {
+			if subject, ok := bytes.CutPrefix(line, []byte("Subject: ")); ok {
+				subjects = append(subjects, string(subject))
+				break
+			}
+		}
+	}
+	return subjects
+}
+
+func newTestConfig(t *testing.T, source, target *testServer) *fetchConfig {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	c := &fetchConfig{Name: "test", ctx: context.Background(), logger: logger}
+	c.Source.FetchServer = source.fetchServer()
+	c.Target = fetchTargets{{FetchServer: target.fetchServer()}}
+	return c
+}
+
+// handleOnce connects the account like a session does and handles all
+// messages once, failing the test if it does not finish in time.
+func handleOnce(t *testing.T, c *fetchConfig) error {
+	t.Helper()
+	err := c.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := c.init()
+		if err == nil {
+			// Updates are only received while watching, which the test skips.
+			c.Source.idleconn.Updates = nil
+			err = c.handleAll()
+		}
+		c.close()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(30 * time.Second):
+		t.Fatal("handling did not finish")
+		return nil
+	}
+}
+
+func assertSubjects(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s: got %q, want %q", what, got, want)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	source.addMessages(t, "INBOX", "one", "two", "three")
+	c := newTestConfig(t, source, target)
+
+	err := handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "one", "two", "three")
+	assertSubjects(t, "source", source.subjects(t, "INBOX"))
+	if c.total != 3 {
+		t.Errorf("total: got %d, want 3", c.total)
+	}
+
+	// Nothing is left to forward on the next cycle.
+	err = handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "one", "two", "three")
+}
+
+// Messages read by another client before they were forwarded are
+// forwarded nevertheless.
+func TestHandleMarkSeen(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	source.addMessages(t, "INBOX", "one", "two")
+	c := newTestConfig(t, source, target)
+	c.Source.Action = actionMarkSeen
+	c.Source.CheckpointFile = filepath.Join(t.TempDir(), "checkpoint.json")
+
+	err := handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.addMessages(t, "INBOX", "three")
+	messages := source.mailbox(t, "INBOX").Messages
+	messages[2].Flags = append(messages[2].Flags, imap.SeenFlag)
+	err = handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "one", "two", "three")
+	assertSubjects(t, "source", source.subjects(t, "INBOX"), "one", "two", "three")
+	for _, msg := range source.mailbox(t, "INBOX").Messages {
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			t.Errorf("message %d not marked as seen: %v", msg.Uid, msg.Flags)
+		}
+	}
+}
+
+// Messages kept on the source are not fetched again on the next cycle,
+// nor after a restart.
+func TestHandleMarkSeenRefetch(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	source.addMessages(t, "INBOX", "one", "two")
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	c := newTestConfig(t, source, target)
+	c.Source.Action = actionMarkSeen
+	c.Source.CheckpointFile = checkpoint
+
+	err := handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := test.NewLocal(c.logger)
+	err = handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logged(hook, "Handling message: ") {
+		t.Error("marked message fetched again")
+	}
+
+	c = newTestConfig(t, source, target)
+	c.Source.Action = actionMarkSeen
+	c.Source.CheckpointFile = checkpoint
+	hook = test.NewLocal(c.logger)
+	err = handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logged(hook, "Handling message: ") {
+		t.Error("marked message fetched again after restart")
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "one", "two")
+}
+
+// Deleting each message while the messages are still being fetched must
+// not block the connection fetching them.
+func TestHandlePerMessage(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	subjects := []string{}
+	for i := 0; i < 100; i++ {
+		subjects = append(subjects, fmt.Sprint(i))
+	}
+	source.addMessages(t, "INBOX", subjects...)
+	c := newTestConfig(t, source, target)
+	c.Source.DeleteMode = deleteModePerMessage
+	c.Pipeline = fetchPipeline{MessageBuffer: 1, DeleteBuffer: 1}
+
+	err := handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), subjects...)
+	assertSubjects(t, "source", source.subjects(t, "INBOX"))
+	if conns := c.Source.connections; conns != 0 {
+		t.Errorf("source connections left open: %d", conns)
+	}
+}
+
+// Messages are handled by UID, even if an expunged message makes their
+// sequence numbers differ from their UIDs.
+func TestHandleExpunged(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	source.addMessages(t, "INBOX", "one", "two", "three", "four")
+	mbox := source.mailbox(t, "INBOX")
+	mbox.Messages = append(mbox.Messages[:1], mbox.Messages[2:]...)
+	for _, msg := range mbox.Messages {
+		if msg.Uid != 3 {
+			msg.Flags = append(msg.Flags, "$Ready")
+		}
+	}
+	c := newTestConfig(t, source, target)
+	c.Source.RequireFlags = []string{"$Ready"}
+
+	err := handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "one", "four")
+	assertSubjects(t, "source", source.subjects(t, "INBOX"), "three")
+}
+
+// Connections waiting for another stage must not run into the timeout of
+// the command they ran last.
+func TestHandleSlowerThanTimeout(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	source.addMessages(t, "INBOX", "one", "two", "three", "four", "five")
+	c := newTestConfig(t, source, target)
+	c.Source.Timeout = time.Second
+	c.Target[0].Timeout = time.Second
+	c.Target[0].RateLimit = 2
+
+	err := handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "one", "two", "three", "four", "five")
+	assertSubjects(t, "source", source.subjects(t, "INBOX"))
+}
@@ -0,0 +1,66 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultInitTimeout = 2 * time.Minute
+
+func (c *fetchConfig) initTimeout() time.Duration {
+	if c.InitTimeout > 0 {
+		return c.InitTimeout
+	}
+	return defaultInitTimeout
+}
+
+// initBounded runs init with connecting and all commands limited to the
+// remaining time of the init timeout, so that a slow or unreachable server
+// fails its account quickly instead of holding it up.
+func (c *fetchConfig) initBounded() error {
+	c.initDeadline = time.Now().Add(c.initTimeout())
+	defer func() {
+		c.initDeadline = time.Time{}
+	}()
+
+	err := c.init()
+	if err != nil && !time.Now().Before(c.initDeadline) {
+		c.log().Warnf("Initialization did not finish within %s", c.initTimeout())
+		return fmt.Errorf("%w: %v", errInitTimeout, err)
+	}
+	return err
+}
+
+// boundedTimeout limits a timeout to the time remaining for init.
+func (c *fetchConfig) boundedTimeout(timeout time.Duration) time.Duration {
+	if c == nil || c.initDeadline.IsZero() {
+		return timeout
+	}
+	// A zero timeout would disable the timeout of the commands.
+	remaining := time.Until(c.initDeadline)
+	if remaining < time.Millisecond {
+		remaining = time.Millisecond
+	}
+	if remaining < timeout {
+		return remaining
+	}
+	return timeout
+}
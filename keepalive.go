@@ -0,0 +1,65 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// startIdle idles on the source connection until ctx is done or the
+// returned function is called, the result is sent to errors.
+func (s *fetchSource) startIdle(ctx context.Context, errors chan<- error) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer trackGoroutine(&accountGoroutines)()
+		errors <- s.idle.IdleWithFallback(ctx.Done(), 0)
+	}()
+	return cancel
+}
+
+// keepaliveTicker returns a ticker for probing the IDLE connection,
+// or nil if keepalive is disabled.
+func (s *fetchSource) keepaliveTicker() *time.Ticker {
+	if s.Keepalive <= 0 {
+		return nil
+	}
+	return time.NewTicker(s.Keepalive)
+}
+
+// keepalive stops idling and sends a NOOP to verify that the connection is
+// still alive, since NAT gateways may drop idle connections unnoticed.
+func (s *fetchSource) keepalive(stopIdle context.CancelFunc, errors <-chan error) error {
+	stopIdle()
+	err := <-errors
+	if err != nil {
+		return err
+	}
+
+	s.idleconn.Timeout = s.timeout()
+	defer func() {
+		s.idleconn.Timeout = 0
+	}()
+	err = s.idleconn.Noop()
+	if err != nil {
+		return err
+	}
+	s.config.log().Debug("Keepalive succeeded")
+	return nil
+}
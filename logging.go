@@ -0,0 +1,73 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func logFileName(name string) string {
+	return unsafeFileNameChars.ReplaceAllString(name, "_") + ".log"
+}
+
+// setupLogger creates a dedicated logger for the account if it has its own
+// log level or writes to a file in dir, sharing formatter and hooks with
+// the global logger.
+func (c *fetchConfig) setupLogger(dir string) error {
+	if dir == "" && c.LogLevel == "" {
+		return nil
+	}
+
+	std := log.StandardLogger()
+	logger := log.New()
+	logger.SetOutput(std.Out)
+	logger.SetLevel(std.GetLevel())
+	logger.SetFormatter(std.Formatter)
+	logger.ReplaceHooks(std.Hooks)
+
+	if c.LogLevel != "" {
+		l, err := log.ParseLevel(c.LogLevel)
+		if err != nil {
+			return err
+		}
+		logger.SetLevel(l)
+	}
+
+	if dir != "" {
+		err := os.MkdirAll(dir, 0750)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, logFileName(c.Name))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		logger.SetOutput(file)
+	}
+
+	c.logger = logger
+	return nil
+}
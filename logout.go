@@ -0,0 +1,52 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	client "github.com/emersion/go-imap/client"
+)
+
+const defaultLogoutTimeout = 10 * time.Second
+
+func (c *fetchConfig) logoutTimeout() time.Duration {
+	if c.LogoutTimeout > 0 {
+		return c.LogoutTimeout
+	}
+	return defaultLogoutTimeout
+}
+
+// logout logs out of the server, but closes the connection if the server
+// does not respond in time, so that shutdown cannot hang on a dead server.
+func (s *FetchServer) logout(con *client.Client) error {
+	timeout := s.config.logoutTimeout()
+	done := make(chan error, 1)
+	go func() {
+		done <- con.Logout()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		con.Terminate()
+		return fmt.Errorf("logout from %s did not finish within %s", s.Server, timeout)
+	}
+}
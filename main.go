@@ -20,25 +20,44 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 
-	"github.com/heroku/rollrus"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/rollbar/rollbar-go"
-	"github.com/rollbar/rollbar-go/errors"
 
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
-	cfg, err := loadConfig()
+	once := flag.Bool("once", false, "forward all pending messages once and exit")
+	configDir := flag.String("config-dir", "", "directory of further config files to load accounts from")
+	validate := flag.Bool("validate", false, "check the configuration and exit without connecting")
+	account := flag.String("account", "", "only run the account with this name")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configDir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *account != "" {
+		err = cfg.selectAccount(*account)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *validate {
+		log.Infof("Configuration of %d accounts is valid", len(cfg.Accounts))
+		return
+	}
 
 	if cfg.Logging != nil && cfg.Logging.Level != "" {
 		l, err := log.ParseLevel(cfg.Logging.Level)
@@ -48,34 +67,109 @@ func main() {
 		log.SetLevel(l)
 	}
 
-	if cfg.Rollbar != nil && cfg.Rollbar.AccessToken != "" {
-		rollbar.SetStackTracer(errors.StackTracer)
-		rollrus.SetupLogging(cfg.Rollbar.AccessToken, cfg.Rollbar.Environment)
-		defer rollrus.ReportPanic(cfg.Rollbar.AccessToken, cfg.Rollbar.Environment)
-		log.Warn("Errors will be reported to rollbar.com!")
+	reporter, err := cfg.reporter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if reporter != nil {
+		hook, err := reporter.hook()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.AddHook(hook)
+		defer reporter.flush()
+		defer reporter.reportPanic()
+		log.Warnf("Errors will be reported to %s!", reporter.name())
+	}
+
+	logDir := ""
+	if cfg.Logging != nil {
+		logDir = cfg.Logging.PerAccountDir
+	}
+	for _, c := range cfg.Accounts {
+		err := c.setupLogger(logDir)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if cfg.Metrics != nil && cfg.Metrics.ListenAddress != "" {
 		cc := NewCollector(cfg)
 		prometheus.MustRegister(cc)
-		http.Handle("/metrics", promhttp.Handler())
-		go http.ListenAndServe(cfg.Metrics.ListenAddress, nil)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", cfg.Metrics.protect(promhttp.Handler()))
+		cfg.Debug.registerPprof(mux, cfg.Metrics)
+		listener, err := listenMetrics(cfg.Metrics.ListenAddress)
+		if err != nil {
+			log.Fatalf("Metrics server failed: %v", err)
+		}
+		server := &http.Server{Handler: mux}
+		defer server.Close()
+		go func() {
+			err := cfg.Metrics.serve(server, listener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Metrics server failed: %v", err)
+			}
+		}()
 	}
 
 	runtime.GC()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+	started := time.Now()
+
+	// In one-shot mode a failing account must not cancel the others.
+	g := new(errgroup.Group)
+	if !*once {
+		g, ctx = errgroup.WithContext(ctx)
+	}
+	if cfg.MQTT != nil && cfg.MQTT.Broker != "" {
+		go func() {
+			err := cfg.MQTT.run(ctx, cfg.Accounts)
+			if err != nil {
+				log.Warnf("MQTT publisher failed: %v", err)
+			}
+		}()
+	}
 
-	g, ctx := errgroup.WithContext(ctx)
+	var handles chan struct{}
+	if cfg.MaxConcurrentHandles > 0 {
+		handles = make(chan struct{}, cfg.MaxConcurrentHandles)
+	}
 	for _, c := range cfg.Accounts {
+		if !c.enabled() {
+			c.state = disabledState
+			c.log().Warn("Account is disabled")
+			continue
+		}
 		c.ctx = ctx
-		c.log().Infof("%s --> %s", c.Source.Server, c.Target.Server)
-		g.Go(c.run)
+		c.handles = handles
+		for _, t := range c.Target {
+			c.log().Infof("%s --> %s", c.Source.Server, t.Server)
+		}
+		switch {
+		case c.Source.MailboxPattern != "" && *once:
+			g.Go(c.runPatternOnce)
+		case c.Source.MailboxPattern != "":
+			g.Go(c.runPattern)
+		case *once:
+			g.Go(c.runOnce)
+		default:
+			g.Go(c.run)
+		}
 	}
 
 	err = g.Wait()
+	for _, c := range cfg.Accounts {
+		if c.enabled() {
+			c.logSummary(started)
+		}
+	}
 	if err != nil {
 		log.Warn(err)
+		if *once {
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,82 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const unixAddressPrefix = "unix:"
+
+// listenMetrics listens on a TCP address or, with a unix: prefix, on a
+// Unix domain socket. The socket file is removed when the listener is closed.
+func listenMetrics(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixAddressPrefix) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, unixAddressPrefix)
+	// Remove a socket file left behind by an unclean shutdown.
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+func (m *configMetrics) validate() error {
+	if (m.TLSCert == "") != (m.TLSKey == "") {
+		return errors.New("TLS certificate and key must be configured together")
+	}
+	if m.Password != "" && m.Username == "" {
+		return errors.New("password configured without username")
+	}
+	return nil
+}
+
+// protect requires basic authentication if a username is configured.
+func (m *configMetrics) protect(handler http.Handler) http.Handler {
+	if m.Username == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(m.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(m.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serve serves HTTPS if a TLS certificate is configured, plain HTTP otherwise.
+func (m *configMetrics) serve(server *http.Server, listener net.Listener) error {
+	if m.TLSCert != "" {
+		return server.ServeTLS(listener, m.TLSCert, m.TLSKey)
+	}
+	return server.Serve(listener)
+}
@@ -0,0 +1,116 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	imap "github.com/emersion/go-imap"
+	client "github.com/emersion/go-imap/client"
+)
+
+const inboxName = "INBOX"
+
+func (t *fetchTarget) validateMailboxPrefix() error {
+	if t.MailboxPrefix != "" && t.Mailbox != "" {
+		return errors.New("Mailbox and MailboxPrefix cannot be configured together")
+	}
+	return nil
+}
+
+// mirrorMailbox returns the target mailbox mirroring a source mailbox below
+// MailboxPrefix, e.g. INBOX/Work becomes Backup/Work with the prefix Backup/.
+// The hierarchy delimiter of the source is replaced by that of the target.
+func (t *fetchTarget) mirrorMailbox(source, sourceDelimiter, targetDelimiter string) string {
+	name := source
+	inbox := inboxName + sourceDelimiter
+	if strings.EqualFold(name, inboxName) {
+		name = ""
+	} else if sourceDelimiter != "" && len(name) > len(inbox) && strings.EqualFold(name[:len(inbox)], inbox) {
+		name = name[len(inbox):]
+	}
+	if name == "" {
+		if targetDelimiter == "" {
+			return t.MailboxPrefix
+		}
+		return strings.TrimSuffix(t.MailboxPrefix, targetDelimiter)
+	}
+	if sourceDelimiter != "" && targetDelimiter != "" {
+		name = strings.ReplaceAll(name, sourceDelimiter, targetDelimiter)
+	}
+	return t.MailboxPrefix + name
+}
+
+// mailboxDelimiter returns the hierarchy delimiter of a mailbox, or of the
+// root of the hierarchy if the name is empty.
+func mailboxDelimiter(con *client.Client, name string) (string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- con.List("", name, mailboxes)
+	}()
+	delimiter := ""
+	for info := range mailboxes {
+		delimiter = info.Delimiter
+	}
+	return delimiter, <-done
+}
+
+// mirrorsSource reports whether the target derives its mailbox from the
+// source mailbox.
+func (t *fetchTarget) mirrorsSource() bool {
+	return t.MailboxPrefix != ""
+}
+
+// listDelimiter looks up the hierarchy delimiter of the source mailbox,
+// unless no target is left to mirror it.
+func (c *fetchConfig) listDelimiter() error {
+	for _, t := range c.Target {
+		if t.mirrorsSource() {
+			delimiter, err := mailboxDelimiter(c.Source.imapconn, c.Source.Mailbox)
+			if err != nil {
+				return err
+			}
+			c.Source.delimiter = delimiter
+			return nil
+		}
+	}
+	return nil
+}
+
+// bindMailbox derives the target mailbox from the source mailbox if the
+// target mirrors the source hierarchy, once connected to the target.
+func (t *fetchTarget) bindMailbox(source *fetchSource) error {
+	if !t.mirrorsSource() {
+		return nil
+	}
+	delimiter, err := mailboxDelimiter(t.imapconn, "")
+	if err != nil {
+		return err
+	}
+	t.mirrored = t.mirrorMailbox(source.Mailbox, source.delimiter, delimiter)
+	return nil
+}
+
+// createMailboxes reports whether missing target mailboxes are created,
+// which mirrored mailboxes always are.
+func (t *fetchTarget) createMailboxes() bool {
+	return t.CreateMailbox || t.MailboxPrefix != ""
+}
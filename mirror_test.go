@@ -0,0 +1,74 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "testing"
+
+func TestMirrorMailbox(t *testing.T) {
+	for _, test := range []struct {
+		prefix, source, sourceDelimiter, targetDelimiter, want string
+	}{
+		{"Backup/", "INBOX", "/", "/", "Backup"},
+		{"Backup/", "inbox", "/", "/", "Backup"},
+		{"Backup/", "INBOX/Work", "/", "/", "Backup/Work"},
+		{"Backup/", "INBOX_Archive", "/", "/", "Backup/INBOX_Archive"},
+		{"Backup/", "INBOX.Work.2024", ".", "/", "Backup/Work/2024"},
+		{"Backup/", "Archive.2024", ".", "/", "Backup/Archive/2024"},
+		{"Backup.", "INBOX/Work", "/", ".", "Backup.Work"},
+		{"Backup", "INBOX", "", "", "Backup"},
+		{"Backup-", "Work", "", "", "Backup-Work"},
+	} {
+		target := &fetchTarget{MailboxPrefix: test.prefix}
+		got := target.mirrorMailbox(test.source, test.sourceDelimiter, test.targetDelimiter)
+		if got != test.want {
+			t.Errorf("mirrorMailbox(%q, %q, %q) with prefix %q: got %q, want %q",
+				test.source, test.sourceDelimiter, test.targetDelimiter, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestHandleMailboxPrefix(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	user, err := source.backend.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.CreateMailbox("INBOX/Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.addMessages(t, "INBOX/Work", "one")
+	c := newTestConfig(t, source, target)
+	c.Source.Mailbox = "INBOX/Work"
+	c.Target[0].Mailbox = ""
+	c.Target[0].MailboxPrefix = "Backup/"
+
+	err = handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "Backup/Work"), "one")
+
+	source.addMessages(t, "INBOX/Work", "two")
+	err = handleOnce(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "Backup/Work"), "one", "two")
+}
@@ -0,0 +1,73 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+
+	imap "github.com/emersion/go-imap"
+	client "github.com/emersion/go-imap/client"
+)
+
+// supportsMove reports whether the server supports the MOVE extension
+// defined in RFC 6851.
+func supportsMove(con *client.Client) (bool, error) {
+	return con.Support("MOVE")
+}
+
+// moveMessages moves messages to another mailbox, with UID MOVE if the
+// server supports it. Otherwise they are copied and deleted, and expunged
+// according to the expunge policy. Without UIDPLUS, EXPUNGE would also
+// remove messages deleted by other clients, so the policy must allow it.
+func moveMessages(con *client.Client, seqset *imap.SeqSet, dest string, expunge string) error {
+	ok, err := supportsMove(con)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return con.UidMove(seqset, dest)
+	}
+
+	uidplus, err := con.Support("UIDPLUS")
+	if err != nil {
+		return err
+	}
+	if !uidplus && expunge == "" {
+		return errors.New("server supports neither MOVE nor UIDPLUS, set Expunge to always or never to move messages")
+	}
+
+	err = con.UidCopy(seqset, dest)
+	if err != nil {
+		return err
+	}
+	err = con.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true),
+		[]interface{}{imap.DeletedFlag}, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case expunge == expungeNever:
+		return nil
+	case expunge == expungeAlways:
+		return con.Expunge(nil)
+	case uidplus:
+		return uidExpunge(con, seqset, nil)
+	}
+	return nil
+}
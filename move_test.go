@@ -0,0 +1,109 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	stdlog "log"
+	"net"
+	"strings"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+	client "github.com/emersion/go-imap/client"
+)
+
+// serveCommands acknowledges every command without MOVE and UIDPLUS, and
+// sends the commands received to ch, except for CAPABILITY.
+func serveCommands(conn net.Conn, ch chan<- string) error {
+	defer close(ch)
+	defer conn.Close()
+	_, err := conn.Write([]byte("* OK [CAPABILITY IMAP4rev1] ready\r\n"))
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if fields[1] == "UID" {
+			fields[1] += " " + fields[2]
+		}
+		if fields[1] != "CAPABILITY" {
+			ch <- fields[1]
+		}
+		_, err = conn.Write([]byte(fields[0] + " OK done\r\n"))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestMoveMessagesFallback(t *testing.T) {
+	for _, tc := range []struct {
+		expunge  string
+		commands []string
+	}{
+		// Expunging would remove messages deleted by other clients.
+		{"", nil},
+		{expungeUid, []string{"UID COPY", "UID STORE"}},
+		{expungeNever, []string{"UID COPY", "UID STORE"}},
+		{expungeAlways, []string{"UID COPY", "UID STORE", "EXPUNGE"}},
+	} {
+		t.Run(tc.expunge, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			ch := make(chan string, 10)
+			go serveCommands(serverConn, ch)
+
+			con, err := client.New(clientConn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			con.ErrorLog = stdlog.New(io.Discard, "", 0)
+			err = con.Login("username", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = con.Select("INBOX", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-ch
+			<-ch
+
+			seqset := new(imap.SeqSet)
+			seqset.AddNum(1)
+			err = moveMessages(con, seqset, "Archive", tc.expunge)
+			if (err != nil) != (tc.commands == nil) {
+				t.Errorf("moveMessages: %v", err)
+			}
+			con.Terminate()
+
+			commands := []string{}
+			for cmd := range ch {
+				commands = append(commands, cmd)
+			}
+			assertSubjects(t, "commands", commands, tc.commands...)
+		})
+	}
+}
@@ -0,0 +1,322 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMQTTClientID        = "go-getmail"
+	defaultMQTTTopicPrefix     = "go-getmail"
+	defaultMQTTDiscoveryPrefix = "homeassistant"
+	defaultMQTTInterval        = 1 * time.Minute
+	mqttTimeout                = 10 * time.Second
+	mqttConnectAttempts        = 5
+	mqttConnectBackoff         = 1 * time.Second
+)
+
+var unsafeTopicChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+type configMQTT struct {
+	Broker          string
+	ClientID        string
+	Username        string
+	Password        string
+	TopicPrefix     string
+	DiscoveryPrefix string
+	Interval        time.Duration
+	Device          mqttDevice
+}
+
+// mqttDevice is the Home Assistant device the sensors belong to, by default
+// each account is a device of its own. Configuring identifiers groups the
+// sensors of all accounts under one device.
+type mqttDevice struct {
+	Identifiers  []string
+	Name         string
+	Manufacturer string
+	Model        string
+	SwVersion    string
+}
+
+// mqttSensor describes a Home Assistant sensor of an account.
+type mqttSensor struct {
+	component   string
+	key         string
+	name        string
+	deviceClass string
+	unit        string
+}
+
+var mqttSensors = []mqttSensor{
+	{component: "binary_sensor", key: "up", name: "Connected", deviceClass: "connectivity"},
+	{component: "sensor", key: "state", name: "State"},
+	{component: "sensor", key: "messages", name: "Forwarded messages", unit: "messages"},
+	{component: "sensor", key: "last_update", name: "Last update", deviceClass: "timestamp"},
+}
+
+// mqttState is the state of an account as published to MQTT.
+type mqttState struct {
+	Up         string `json:"up"`
+	State      string `json:"state"`
+	Messages   uint64 `json:"messages"`
+	LastUpdate string `json:"last_update,omitempty"`
+}
+
+func (s fetchState) name() string {
+	switch s {
+	case connectingState:
+		return "connecting"
+	case connectedState:
+		return "connected"
+	case watchingState:
+		return "watching"
+	case handlingState:
+		return "handling"
+	case shutdownState:
+		return "shutdown"
+	case disabledState:
+		return "disabled"
+	case overQuotaState:
+		return "over-quota"
+	}
+	return "initial"
+}
+
+func (m *configMQTT) clientID() string {
+	if m.ClientID != "" {
+		return m.ClientID
+	}
+	return defaultMQTTClientID
+}
+
+func (m *configMQTT) topicPrefix() string {
+	if m.TopicPrefix != "" {
+		return m.TopicPrefix
+	}
+	return defaultMQTTTopicPrefix
+}
+
+func (m *configMQTT) discoveryPrefix() string {
+	if m.DiscoveryPrefix != "" {
+		return m.DiscoveryPrefix
+	}
+	return defaultMQTTDiscoveryPrefix
+}
+
+func (m *configMQTT) interval() time.Duration {
+	if m.Interval > 0 {
+		return m.Interval
+	}
+	return defaultMQTTInterval
+}
+
+func (m *configMQTT) objectID(c *fetchConfig) string {
+	return unsafeTopicChars.ReplaceAllString(m.clientID()+"_"+c.Name, "_")
+}
+
+func (m *configMQTT) stateTopic(c *fetchConfig) string {
+	return fmt.Sprintf("%s/%s/state", m.topicPrefix(), m.objectID(c))
+}
+
+func (m *configMQTT) connect() (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.Broker).
+		SetClientID(m.clientID()).
+		SetUsername(m.Username).
+		SetPassword(m.Password).
+		SetAutoReconnect(true)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		client.Disconnect(0)
+		return nil, fmt.Errorf("connecting to %s timed out", m.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// connectRetry connects to the broker with retries, so that a broker
+// being briefly unavailable at startup does not stop the publisher.
+func (m *configMQTT) connectRetry(ctx context.Context) (mqtt.Client, error) {
+	backoff := mqttConnectBackoff
+	for attempt := 1; ; attempt++ {
+		client, err := m.connect()
+		if err == nil || attempt >= mqttConnectAttempts {
+			return client, err
+		}
+
+		log.Warnf("MQTT connect attempt %d of %d failed, retrying in %s: %v",
+			attempt, mqttConnectAttempts, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (m *configMQTT) publish(client mqtt.Client, topic string, retained bool, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	token := client.Publish(topic, 0, retained, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("publishing to %s timed out", topic)
+	}
+	return token.Error()
+}
+
+// device returns the Home Assistant device of the sensors of an account.
+func (m *configMQTT) device(c *fetchConfig) map[string]interface{} {
+	device := map[string]interface{}{
+		"identifiers": []string{m.objectID(c)},
+		"name":        c.Name,
+	}
+	if len(m.Device.Identifiers) > 0 {
+		device["identifiers"] = m.Device.Identifiers
+		device["name"] = m.clientID()
+	}
+	if m.Device.Name != "" {
+		device["name"] = m.Device.Name
+	}
+	if m.Device.Manufacturer != "" {
+		device["manufacturer"] = m.Device.Manufacturer
+	}
+	if m.Device.Model != "" {
+		device["model"] = m.Device.Model
+	}
+	if m.Device.SwVersion != "" {
+		device["sw_version"] = m.Device.SwVersion
+	}
+	return device
+}
+
+// discoveryConfig returns the Home Assistant discovery config of a sensor
+// of an account.
+func (m *configMQTT) discoveryConfig(c *fetchConfig, s mqttSensor) map[string]interface{} {
+	id := m.objectID(c)
+	name := s.name
+	// Sensors of several accounts sharing a device need to tell them apart.
+	if len(m.Device.Identifiers) > 0 {
+		name = c.Name + " " + s.name
+	}
+	config := map[string]interface{}{
+		"name":           name,
+		"unique_id":      id + "_" + s.key,
+		"state_topic":    m.stateTopic(c),
+		"value_template": fmt.Sprintf("{{ value_json.%s }}", s.key),
+		"device":         m.device(c),
+	}
+	if s.deviceClass != "" {
+		config["device_class"] = s.deviceClass
+	}
+	if s.unit != "" {
+		config["unit_of_measurement"] = s.unit
+		config["state_class"] = "total_increasing"
+	}
+	return config
+}
+
+// publishDiscovery announces the sensors of all accounts to Home Assistant.
+func (m *configMQTT) publishDiscovery(client mqtt.Client, accounts []*fetchConfig) error {
+	for _, c := range accounts {
+		id := m.objectID(c)
+		for _, s := range mqttSensors {
+			topic := fmt.Sprintf("%s/%s/%s/%s/config", m.discoveryPrefix(), s.component, id, s.key)
+			err := m.publish(client, topic, true, m.discoveryConfig(c, s))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *configMQTT) publishState(client mqtt.Client, accounts []*fetchConfig) error {
+	for _, c := range accounts {
+		accountState := c.accountState()
+		state := mqttState{
+			Up:    "OFF",
+			State: accountState.name(),
+		}
+		if accountState.up() {
+			state.Up = "ON"
+		}
+		lastUpdate := int64(0)
+		c.eachAccount(func(m *fetchConfig) {
+			state.Messages += atomic.LoadUint64(&m.total)
+			lastUpdate = max(lastUpdate, atomic.LoadInt64(&m.lastUpdate))
+		})
+		if lastUpdate > 0 {
+			state.LastUpdate = time.Unix(lastUpdate, 0).Format(time.RFC3339)
+		}
+		err := m.publish(client, m.stateTopic(c), false, state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run publishes the state of all accounts periodically until ctx is done.
+func (m *configMQTT) run(ctx context.Context, accounts []*fetchConfig) error {
+	client, err := m.connectRetry(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer client.Disconnect(250)
+
+	err = m.publishDiscovery(client, accounts)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(m.interval())
+	defer ticker.Stop()
+	for {
+		err = m.publishState(client, accounts)
+		if err != nil {
+			log.Warnf("MQTT publishing failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiscoveryDevice(t *testing.T) {
+	c := &fetchConfig{Name: "work"}
+	for _, test := range []struct {
+		device       mqttDevice
+		name, config string
+	}{
+		{
+			mqttDevice{},
+			"Connected",
+			`{"identifiers":["go-getmail_work"],"name":"work"}`,
+		},
+		{
+			mqttDevice{Identifiers: []string{"mail"}, Manufacturer: "mback2k", Model: "go-getmail", SwVersion: "v1.2.3"},
+			"work Connected",
+			`{"identifiers":["mail"],"manufacturer":"mback2k","model":"go-getmail","name":"go-getmail","sw_version":"v1.2.3"}`,
+		},
+		{
+			mqttDevice{Identifiers: []string{"mail"}, Name: "Mail forwarding"},
+			"work Connected",
+			`{"identifiers":["mail"],"name":"Mail forwarding"}`,
+		},
+	} {
+		m := &configMQTT{Device: test.device}
+		config := m.discoveryConfig(c, mqttSensors[0])
+		if config["name"] != test.name {
+			t.Errorf("name: got %q, want %q", config["name"], test.name)
+		}
+		device, err := json.Marshal(config["device"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(device) != test.config {
+			t.Errorf("device: got %s, want %s", device, test.config)
+		}
+	}
+}
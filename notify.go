@@ -0,0 +1,323 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	idle "github.com/emersion/go-imap-idle"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// defaultNotifyRestart is how often IDLE is restarted on the NOTIFY
+// connection, so that the server does not log it out.
+const defaultNotifyRestart = 25 * time.Minute
+
+// notifyCommand is a NOTIFY SET STATUS command, as defined in RFC 5465,
+// asking for the status of mailboxes receiving or losing messages. The
+// status of all mailboxes is sent right away.
+type notifyCommand struct {
+	Mailboxes []string
+}
+
+func (cmd *notifyCommand) Command() *imap.Command {
+	if len(cmd.Mailboxes) == 0 {
+		return &imap.Command{
+			Name:      "NOTIFY",
+			Arguments: []interface{}{imap.RawString("NONE")},
+		}
+	}
+	mailboxes := make([]interface{}, len(cmd.Mailboxes))
+	for i, name := range cmd.Mailboxes {
+		encoded, _ := utf7.Encoding.NewEncoder().String(name)
+		mailboxes[i] = imap.FormatMailboxName(encoded)
+	}
+	events := []interface{}{imap.RawString("MessageNew"), imap.RawString("MessageExpunge")}
+	return &imap.Command{
+		Name: "NOTIFY",
+		Arguments: []interface{}{
+			imap.RawString("SET"),
+			imap.RawString("STATUS"),
+			[]interface{}{imap.RawString("MAILBOXES"), mailboxes, events},
+		},
+	}
+}
+
+// notifyHandler passes the STATUS responses of the watched mailboxes on.
+type notifyHandler func(status *imap.MailboxStatus)
+
+func (h notifyHandler) Handle(resp imap.Resp) error {
+	r := new(responses.Status)
+	if r.Handle(resp) != nil {
+		return responses.ErrUnhandled
+	}
+	h(r.Mailbox)
+	return nil
+}
+
+// notifyIdleResponse handles the responses while idling with NOTIFY.
+type notifyIdleResponse struct {
+	*idle.Response
+	status notifyHandler
+}
+
+func (r *notifyIdleResponse) Handle(resp imap.Resp) error {
+	err := r.status.Handle(resp)
+	if err != responses.ErrUnhandled {
+		return err
+	}
+	return r.Response.Handle(resp)
+}
+
+// supportsNotify reports whether the mailboxes are to be watched with
+// NOTIFY on a single connection instead of IDLE on each of them.
+func (s *fetchSource) supportsNotify() (bool, error) {
+	if !s.Notify {
+		return false, nil
+	}
+	return s.imapconn.Support("NOTIFY")
+}
+
+// notifyMailboxes replaces the mailboxes watched on the NOTIFY connection.
+func (s *fetchSource) notifyMailboxes(mailboxes []string, h notifyHandler) error {
+	s.idleconn.Timeout = s.timeout()
+	defer func() {
+		s.idleconn.Timeout = 0
+	}()
+	status, err := s.idleconn.Execute(&notifyCommand{Mailboxes: mailboxes}, h)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// idleNotify idles on the NOTIFY connection until stop is closed.
+func (s *fetchSource) idleNotify(stop <-chan struct{}, h notifyHandler) error {
+	res := &notifyIdleResponse{
+		Response: &idle.Response{Stop: stop, RepliesCh: make(chan []byte, 10)},
+		status:   h,
+	}
+	status, err := s.idleconn.Execute(&idle.Command{}, res)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// notifyRestart returns how often IDLE is interrupted on the NOTIFY
+// connection, which is also used for keepalive.
+func (s *fetchSource) notifyRestart() time.Duration {
+	if s.Keepalive > 0 {
+		return s.Keepalive
+	}
+	return defaultNotifyRestart
+}
+
+// notify passes the status on to the account forwarding the mailbox. Only
+// the latest status is kept, since it includes the changes before it.
+func (s *fetchSource) notify(status *imap.MailboxStatus) {
+	for {
+		select {
+		case s.notifications <- status:
+			return
+		default:
+		}
+		select {
+		case <-s.notifications:
+		default:
+		}
+	}
+}
+
+// notifyMailbox passes the status of a mailbox matching the pattern on to
+// the account forwarding it.
+func (c *fetchConfig) notifyMailbox(status *imap.MailboxStatus) {
+	m := c.mailboxConfigs()[status.Name]
+	if m == nil || m.Source.notifications == nil {
+		c.log().Debugf("Status of unwatched mailbox: %s", status.Name)
+		return
+	}
+	m.Source.notify(status)
+}
+
+// mailboxNames returns the sorted names of the mailboxes matching the pattern.
+func (c *fetchConfig) mailboxNames() []string {
+	mailboxes := c.mailboxConfigs()
+	names := make([]string, 0, len(mailboxes))
+	for name := range mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newNotifier registers the account watching the mailboxes matching the
+// pattern with NOTIFY, which has a connection of its own.
+func (c *fetchConfig) newNotifier() *fetchConfig {
+	n := &fetchConfig{
+		fetchSettings: c.fetchSettings,
+		Name:          c.Name,
+		Source:        c.Source,
+		ctx:           c.ctx,
+		logger:        c.logger,
+	}
+	n.bind()
+	c.mailboxLock.Lock()
+	defer c.mailboxLock.Unlock()
+	c.notifier = n
+	return n
+}
+
+// runNotify watches all mailboxes matching the pattern with NOTIFY on the
+// connection of s, reconnecting until the account is stopped. The
+// mailboxes are watched again each time changed receives.
+func (c *fetchConfig) runNotify(s *fetchSource, changed <-chan struct{}) error {
+	defer trackGoroutine(&accountGoroutines)()
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := c.notifySession(s, changed)
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+
+		wait := c.jitter(delay)
+		c.log().Warnf("Reconnecting NOTIFY in %s: %v", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return nil
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// notifySession watches the mailboxes on a single connection until it
+// fails or the account is stopped.
+func (c *fetchConfig) notifySession(s *fetchSource, changed <-chan struct{}) error {
+	err := s.openIDLE()
+	if err != nil {
+		return err
+	}
+	defer s.closeIDLE()
+
+	c.log().Info("Begin watching mailboxes with NOTIFY")
+
+	restart := time.NewTicker(s.notifyRestart())
+	defer restart.Stop()
+	for {
+		err = s.notifyMailboxes(c.mailboxNames(), c.notifyMailbox)
+		if err != nil {
+			return err
+		}
+
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			defer trackGoroutine(&accountGoroutines)()
+			done <- s.idleNotify(stop, c.notifyMailbox)
+		}()
+		select {
+		case <-changed:
+		case <-restart.C:
+		case <-c.ctx.Done():
+		case err = <-done:
+			if err == nil {
+				err = errors.New("server stopped idling")
+			}
+			return err
+		}
+		close(stop)
+		err = <-done
+		if err != nil {
+			return err
+		}
+		if c.ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// newMessages reports whether the status announces new messages compared
+// to the last one, only the UIDs of new messages are above UIDNEXT.
+func newMessages(last, status *imap.MailboxStatus) bool {
+	return last == nil || status.UidNext == 0 || status.UidNext != last.UidNext
+}
+
+// watchNotify waits for the status of the mailbox, which is sent by the
+// account watching all mailboxes matching the pattern with NOTIFY.
+func (c *fetchConfig) watchNotify() error {
+	defer func(c *fetchConfig, s fetchState) {
+		c.state = s
+	}(c, c.state)
+	c.state = watchingState
+
+	// Messages received while not connected are not announced.
+	err := c.handleAll()
+	if err != nil {
+		return err
+	}
+
+	c.log().Info("Begin waiting for notifications")
+
+	// Bursts of notifications are collected and handled at once.
+	var debounce <-chan time.Time
+	var last *imap.MailboxStatus
+	for {
+		select {
+		case status := <-c.Source.notifications:
+			atomic.StoreInt64(&c.lastUpdate, time.Now().Unix())
+			if !newMessages(last, status) {
+				c.log().Debugf("Mailbox status without new messages: %d", status.Messages)
+				continue
+			}
+			c.log().Infof("New messages, next UID: %d", status.UidNext)
+			last = status
+			if window := c.debounce(); window > 0 {
+				if debounce == nil {
+					debounce = time.After(window)
+				}
+				continue
+			}
+			err := c.handleAll()
+			if err != nil {
+				return err
+			}
+		case <-debounce:
+			debounce = nil
+			err := c.handleAll()
+			if err != nil {
+				return err
+			}
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	stdlog "log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	client "github.com/emersion/go-imap/client"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serveNotify answers NOTIFY with the status of the mailboxes and sends
+// another status while idling, the NOTIFY commands are sent to ch.
+func serveNotify(conn net.Conn, ch chan<- string) error {
+	defer close(ch)
+	defer conn.Close()
+	_, err := conn.Write([]byte("* OK [CAPABILITY IMAP4rev1 IDLE NOTIFY] ready\r\n"))
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		reply := ""
+		switch strings.Fields(fields[1])[0] {
+		case "NOTIFY":
+			ch <- fields[1]
+			reply = "* STATUS Work (MESSAGES 1 UIDNEXT 2)\r\n" +
+				"* STATUS Other (MESSAGES 1 UIDNEXT 5)\r\n"
+		case "IDLE":
+			_, err = conn.Write([]byte("+ idling\r\n* STATUS Work (MESSAGES 2 UIDNEXT 3)\r\n"))
+			if err != nil {
+				return err
+			}
+			_, err = r.ReadString('\n')
+			if err != nil {
+				return err
+			}
+		}
+		_, err = conn.Write([]byte(reply + fields[0] + " OK done\r\n"))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	ch := make(chan string, 10)
+	go serveNotify(serverConn, ch)
+
+	con, err := client.New(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con.ErrorLog = stdlog.New(io.Discard, "", 0)
+	defer con.Terminate()
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	c := &fetchConfig{Name: "test", ctx: context.Background(), logger: logger}
+	c.Source.MailboxPattern = "*"
+	c.bind()
+	m := c.clone(c.ctx, "Work")
+	m.Source.notifications = make(chan *imap.MailboxStatus, 1)
+	c.addMailbox("Work", m)
+	c.Source.idleconn = con
+
+	err = c.Source.notifyMailboxes(c.mailboxNames(), c.notifyMailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := <-ch; cmd != "NOTIFY SET STATUS (MAILBOXES (\"Work\") (MessageNew MessageExpunge))" {
+		t.Errorf("unexpected command: %s", cmd)
+	}
+	status := <-m.Source.notifications
+	if status.Name != "Work" || status.UidNext != 2 {
+		t.Errorf("unexpected status: %s %d", status.Name, status.UidNext)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Source.idleNotify(stop, c.notifyMailbox)
+	}()
+	status = <-m.Source.notifications
+	if status.UidNext != 3 {
+		t.Errorf("unexpected status while idling: %d", status.UidNext)
+	}
+	close(stop)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchNotify(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	c := newTestConfig(t, source, target)
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.ctx = ctx
+	c.Source.notifications = make(chan *imap.MailboxStatus, 1)
+	err := c.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.session()
+	}()
+	waitCycles := func(want uint64) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for atomic.LoadUint64(&c.emptyCycles) < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("cycles: got %d, want %d", atomic.LoadUint64(&c.emptyCycles), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// Messages received before watching are handled right away.
+	waitCycles(1)
+
+	c.Source.notify(&imap.MailboxStatus{Name: "INBOX", Messages: 1, UidNext: 3})
+	waitCycles(2)
+
+	cancel()
+	err = <-done
+	if err != context.Canceled {
+		t.Errorf("session: %v", err)
+	}
+}
+
+func TestNewMessages(t *testing.T) {
+	last := &imap.MailboxStatus{Messages: 2, UidNext: 5}
+	for _, tc := range []struct {
+		status *imap.MailboxStatus
+		want   bool
+	}{
+		{&imap.MailboxStatus{Messages: 1, UidNext: 5}, false},
+		{&imap.MailboxStatus{Messages: 2, UidNext: 6}, true},
+		{&imap.MailboxStatus{Messages: 2}, true},
+	} {
+		got := newMessages(last, tc.status)
+		if got != tc.want {
+			t.Errorf("newMessages(%d): got %t, want %t", tc.status.UidNext, got, tc.want)
+		}
+	}
+	if !newMessages(nil, last) {
+		t.Error("first status not handled")
+	}
+}
@@ -0,0 +1,289 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultRelistInterval = 5 * time.Minute
+
+func (s *fetchSource) relistInterval() time.Duration {
+	if s.RelistInterval > 0 {
+		return s.RelistInterval
+	}
+	return defaultRelistInterval
+}
+
+// listMailboxes returns the selectable mailboxes matching MailboxPattern,
+// except the mailbox forwarded messages are moved to, and whether they are
+// to be watched with NOTIFY.
+func (c *fetchConfig) listMailboxes() ([]string, bool, error) {
+	err := c.Source.openIMAP()
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.Source.closeIMAP()
+
+	notify, err := c.Source.supportsNotify()
+	if err != nil {
+		return nil, false, err
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Source.imapconn.List("", c.Source.MailboxPattern, mailboxes)
+	}()
+	var names []string
+	for info := range mailboxes {
+		if hasFlag(info.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+		if c.Source.action() == actionMove && info.Name == c.Source.MoveMailbox {
+			continue
+		}
+		names = append(names, info.Name)
+	}
+	return names, notify, <-done
+}
+
+// clone returns a copy of the account forwarding only the given mailbox.
+func (c *fetchConfig) clone(ctx context.Context, mailbox string) *fetchConfig {
+	m := &fetchConfig{
+		fetchSettings: c.fetchSettings,
+		Name:          c.Name + "/" + mailbox,
+		Source:        c.Source,
+		handles:       c.handles,
+		ctx:           ctx,
+		logger:        c.logger,
+	}
+	m.Source.Mailbox = mailbox
+	m.Source.MailboxPattern = ""
+	if m.Source.CheckpointFile != "" {
+		m.Source.CheckpointFile += "." + unsafeFileNameChars.ReplaceAllString(mailbox, "_")
+	}
+	for _, t := range c.Target {
+		target := *t
+		m.Target = append(m.Target, &target)
+	}
+	m.bind()
+	return m
+}
+
+// addMailbox registers the account forwarding a mailbox matching the
+// pattern, so that its metrics are reported.
+func (c *fetchConfig) addMailbox(name string, m *fetchConfig) {
+	c.mailboxLock.Lock()
+	defer c.mailboxLock.Unlock()
+	if c.mailboxes == nil {
+		c.mailboxes = map[string]*fetchConfig{}
+	}
+	c.mailboxes[name] = m
+}
+
+// mailboxConfigs returns the accounts forwarding each mailbox, which is
+// the account itself unless it forwards the mailboxes matching a pattern.
+func (c *fetchConfig) mailboxConfigs() map[string]*fetchConfig {
+	if c.Source.MailboxPattern == "" {
+		return map[string]*fetchConfig{c.Source.Mailbox: c}
+	}
+	c.mailboxLock.Lock()
+	defer c.mailboxLock.Unlock()
+	mailboxes := make(map[string]*fetchConfig, len(c.mailboxes))
+	for name, m := range c.mailboxes {
+		mailboxes[name] = m
+	}
+	return mailboxes
+}
+
+// removeMailbox drops the account forwarding a mailbox which no longer
+// matches the pattern. Its counters are added to the account, so that the
+// sums reported for the account never decrease.
+func (c *fetchConfig) removeMailbox(name string) {
+	c.mailboxLock.Lock()
+	defer c.mailboxLock.Unlock()
+	m := c.mailboxes[name]
+	if m == nil {
+		return
+	}
+	delete(c.mailboxes, name)
+	atomic.AddUint64(&c.total, atomic.LoadUint64(&m.total))
+	atomic.AddUint64(&c.watchdogTrips, atomic.LoadUint64(&m.watchdogTrips))
+	atomic.AddUint64(&c.emptyCycles, atomic.LoadUint64(&m.emptyCycles))
+	atomic.AddInt64(&c.compressSaved, atomic.LoadInt64(&m.compressSaved))
+}
+
+// eachAccount calls f for the account itself, the accounts forwarding the
+// mailboxes matching its pattern and the one watching them with NOTIFY,
+// whose values add up to those of the account. Mailboxes are not removed
+// meanwhile, so that their counters are not added twice.
+func (c *fetchConfig) eachAccount(f func(m *fetchConfig)) {
+	c.mailboxLock.Lock()
+	defer c.mailboxLock.Unlock()
+	f(c)
+	if c.Source.MailboxPattern == "" {
+		return
+	}
+	for _, m := range c.mailboxes {
+		f(m)
+	}
+	if c.notifier != nil {
+		f(c.notifier)
+	}
+}
+
+// accountState returns the state of the account, which is the state of
+// the least healthy mailbox if it forwards the mailboxes matching a pattern.
+func (c *fetchConfig) accountState() fetchState {
+	mailboxes := c.mailboxConfigs()
+	if c.Source.MailboxPattern == "" || len(mailboxes) == 0 {
+		return c.state
+	}
+	names := make([]string, 0, len(mailboxes))
+	for name := range mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	state := watchingState
+	for _, name := range names {
+		s := mailboxes[name].state
+		switch {
+		case !s.up():
+			return s
+		case s == connectedState, s == handlingState && state == watchingState:
+			state = s
+		}
+	}
+	return state
+}
+
+// runPattern forwards all mailboxes matching MailboxPattern, picking up
+// new mailboxes and dropping removed ones on each re-list.
+//
+// If the server supports NOTIFY and Notify is enabled, the mailboxes are
+// watched on a single connection instead of one IDLE connection each. This
+// is decided on the first listing, later ones keep the way of watching.
+func (c *fetchConfig) runPattern() error {
+	defer trackGoroutine(&accountGoroutines)()
+	c.bind()
+	running := map[string]context.CancelFunc{}
+	g := new(errgroup.Group)
+	var changed chan struct{}
+	listed := false
+	for {
+		mailboxes, notify, err := c.listMailboxes()
+		if err != nil {
+			c.log().Warnf("Listing mailboxes matching %s failed: %v", c.Source.MailboxPattern, err)
+		} else {
+			if !listed {
+				listed = true
+				if notify {
+					changed = make(chan struct{}, 1)
+					n := c.newNotifier()
+					g.Go(func() error {
+						return c.runNotify(&n.Source, changed)
+					})
+				} else if c.Source.Notify {
+					c.log().Info("Server does not support NOTIFY, idling on each mailbox")
+				}
+			}
+			updated := false
+			matched := map[string]bool{}
+			for _, name := range mailboxes {
+				matched[name] = true
+				if running[name] != nil {
+					continue
+				}
+				ctx, cancel := context.WithCancel(c.ctx)
+				running[name] = cancel
+				m := c.clone(ctx, name)
+				if changed != nil {
+					m.Source.notifications = make(chan *imap.MailboxStatus, 1)
+				}
+				c.addMailbox(name, m)
+				m.log().Infof("Mailbox %s matches %s", name, c.Source.MailboxPattern)
+				g.Go(m.run)
+				updated = true
+			}
+			for name, cancel := range running {
+				if !matched[name] {
+					c.log().Infof("Mailbox %s no longer matches %s", name, c.Source.MailboxPattern)
+					cancel()
+					delete(running, name)
+					c.removeMailbox(name)
+					updated = true
+				}
+			}
+			if updated && changed != nil {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+
+		select {
+		case <-time.After(c.Source.relistInterval()):
+		case <-c.ctx.Done():
+			return g.Wait()
+		}
+	}
+}
+
+// runPatternOnce forwards all pending messages of the mailboxes matching
+// MailboxPattern once.
+func (c *fetchConfig) runPatternOnce() error {
+	defer trackGoroutine(&accountGoroutines)()
+	c.bind()
+	mailboxes, _, err := c.listMailboxes()
+	if err != nil {
+		return err
+	}
+	g := new(errgroup.Group)
+	for _, name := range mailboxes {
+		m := c.clone(c.ctx, name)
+		c.addMailbox(name, m)
+		g.Go(m.runOnce)
+	}
+	return g.Wait()
+}
+
+// validateMailboxPattern makes sure that either a mailbox or a pattern
+// is configured, NOTIFY is only used for the mailboxes of a pattern.
+func (s *fetchSource) validateMailboxPattern() error {
+	if s.MailboxPattern != "" && s.Mailbox != "" {
+		return errors.New("Mailbox and MailboxPattern cannot be configured together")
+	}
+	if s.MailboxPattern == "" && s.Mailbox == "" {
+		return errors.New("either Mailbox or MailboxPattern must be configured")
+	}
+	if s.Notify && s.MailboxPattern == "" {
+		return errors.New("Notify requires MailboxPattern")
+	}
+	return nil
+}
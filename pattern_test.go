@@ -0,0 +1,140 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAccountState(t *testing.T) {
+	c := &fetchConfig{Name: "test"}
+	c.Source.MailboxPattern = "*"
+	if got := c.accountState(); got != initialState {
+		t.Errorf("without mailboxes: got %s, want %s", got.name(), initialState.name())
+	}
+
+	for _, test := range []struct {
+		states []fetchState
+		want   fetchState
+	}{
+		{[]fetchState{watchingState, watchingState}, watchingState},
+		{[]fetchState{watchingState, handlingState}, handlingState},
+		{[]fetchState{handlingState, connectedState}, connectedState},
+		{[]fetchState{watchingState, connectingState}, connectingState},
+		{[]fetchState{overQuotaState, handlingState}, overQuotaState},
+	} {
+		c.mailboxes = nil
+		for i, state := range test.states {
+			m := &fetchConfig{state: state}
+			c.addMailbox(string(rune('a'+i)), m)
+		}
+		if got := c.accountState(); got != test.want {
+			t.Errorf("mailboxes %v: got %s, want %s", test.states, got.name(), test.want.name())
+		}
+	}
+
+	c.removeMailbox("b")
+	if got := c.accountState(); got != overQuotaState {
+		t.Errorf("after removing a mailbox: got %s, want %s", got.name(), overQuotaState.name())
+	}
+	c.removeMailbox("a")
+	if got := c.accountState(); got != initialState {
+		t.Errorf("after removing all mailboxes: got %s, want %s", got.name(), initialState.name())
+	}
+}
+
+func TestCloneSettings(t *testing.T) {
+	jitter := 0.5
+	c := &fetchConfig{Name: "test"}
+	c.fetchSettings = fetchSettings{
+		LogLevel:        "debug",
+		HandleTimeout:   time.Minute,
+		InitTimeout:     2 * time.Minute,
+		LogoutTimeout:   3 * time.Second,
+		ReconnectJitter: &jitter,
+		Pipeline:        fetchPipeline{MessageBuffer: 5, DeleteBuffer: 7},
+	}
+	c.Source.MailboxPattern = "INBOX/*"
+	c.Source.CheckpointFile = "checkpoint.json"
+	c.Target = fetchTargets{{}}
+
+	m := c.clone(context.Background(), "INBOX/Work")
+	if !reflect.DeepEqual(m.fetchSettings, c.fetchSettings) {
+		t.Errorf("settings: got %+v, want %+v", m.fetchSettings, c.fetchSettings)
+	}
+	if m.Name != "test/INBOX/Work" || m.Source.Mailbox != "INBOX/Work" || m.Source.MailboxPattern != "" {
+		t.Errorf("mailbox: got %s forwarding %q matching %q", m.Name, m.Source.Mailbox, m.Source.MailboxPattern)
+	}
+	if m.Source.CheckpointFile != "checkpoint.json.INBOX_Work" {
+		t.Errorf("checkpoint file: got %s", m.Source.CheckpointFile)
+	}
+	if m.Target[0] == c.Target[0] {
+		t.Error("targets shared with the account")
+	}
+}
+
+// The counters of an account do not decrease once a mailbox no longer
+// matches its pattern.
+func TestRemoveMailboxCounters(t *testing.T) {
+	c := &fetchConfig{Name: "test"}
+	c.Source.MailboxPattern = "*"
+	c.addMailbox("a", &fetchConfig{total: 1, watchdogTrips: 2, emptyCycles: 3, compressSaved: 4})
+	c.addMailbox("b", &fetchConfig{total: 5})
+	sum := func() []int64 {
+		sums := make([]int64, 4)
+		c.eachAccount(func(m *fetchConfig) {
+			sums[0] += int64(m.total)
+			sums[1] += int64(m.watchdogTrips)
+			sums[2] += int64(m.emptyCycles)
+			sums[3] += m.compressSaved
+		})
+		return sums
+	}
+
+	before := sum()
+	c.removeMailbox("a")
+	if after := sum(); !reflect.DeepEqual(after, before) {
+		t.Errorf("sums after removing a mailbox: got %v, want %v", after, before)
+	}
+}
+
+func TestValidateMailboxPattern(t *testing.T) {
+	for _, test := range []struct {
+		mailbox, pattern string
+		notify           bool
+		valid            bool
+	}{
+		{"INBOX", "", false, true},
+		{"", "INBOX/*", false, true},
+		{"INBOX", "INBOX/*", false, false},
+		{"", "", false, false},
+		{"", "INBOX/*", true, true},
+		{"INBOX", "", true, false},
+	} {
+		s := &fetchSource{MailboxPattern: test.pattern, Notify: test.notify}
+		s.Mailbox = test.mailbox
+		err := s.validateMailboxPattern()
+		if (err == nil) != test.valid {
+			t.Errorf("mailbox %q, pattern %q and notify %t: got %v", test.mailbox, test.pattern, test.notify, err)
+		}
+	}
+}
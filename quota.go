@@ -0,0 +1,62 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+)
+
+// overQuotaCode is the response code of a target over its quota, as
+// defined in RFC 9208 section 4.3.
+const overQuotaCode = "OVERQUOTA"
+
+var errOverQuota = errors.New("target is over quota")
+
+// quotaError returns errOverQuota if the server rejected a command for
+// exceeding the quota, otherwise the error of the status.
+func quotaError(status *imap.StatusResp) error {
+	err := status.Err()
+	if err != nil && status.Code == overQuotaCode {
+		return fmt.Errorf("%w: %s", errOverQuota, status.Info)
+	}
+	return err
+}
+
+// pauseOverQuota marks the account as over quota while it waits for the
+// next attempt, only the first failed attempt is logged as a warning.
+func (c *fetchConfig) pauseOverQuota(wait time.Duration, err error) {
+	c.state = overQuotaState
+	if atomic.CompareAndSwapInt32(&c.overQuota, 0, 1) {
+		c.log().Warnf("Pausing account, retrying in %s: %v", wait, err)
+		return
+	}
+	c.log().Debugf("Still over quota, retrying in %s: %v", wait, err)
+}
+
+// resumeQuota logs once that the target accepts messages again.
+func (c *fetchConfig) resumeQuota() {
+	if atomic.CompareAndSwapInt32(&c.overQuota, 1, 0) {
+		c.log().Info("Target accepts messages again, resuming account")
+	}
+}
@@ -0,0 +1,49 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errorReporter reports logged errors and panics to an external service.
+type errorReporter interface {
+	name() string
+	hook() (log.Hook, error)
+	// reportPanic must be deferred directly, it panics again after reporting.
+	reportPanic()
+	flush()
+}
+
+// reporter returns the configured error reporter, if any.
+func (cfg *config) reporter() (errorReporter, error) {
+	useRollbar := cfg.Rollbar != nil && cfg.Rollbar.AccessToken != ""
+	useSentry := cfg.Sentry != nil && cfg.Sentry.DSN != ""
+	switch {
+	case useRollbar && useSentry:
+		return nil, errors.New("only one of Rollbar and Sentry can be configured")
+	case useRollbar:
+		return cfg.Rollbar, nil
+	case useSentry:
+		return cfg.Sentry, nil
+	}
+	return nil, nil
+}
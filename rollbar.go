@@ -0,0 +1,64 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/heroku/rollrus"
+	"github.com/rollbar/rollbar-go"
+	rollbarerrors "github.com/rollbar/rollbar-go/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (r *configRollbar) name() string {
+	return "rollbar.com"
+}
+
+// hook returns a logging hook reporting to Rollbar with the optional
+// code version, server host and custom fields set.
+func (r *configRollbar) hook() (log.Hook, error) {
+	rollbar.SetStackTracer(rollbarerrors.StackTracer)
+	hook := rollrus.NewHook(r.AccessToken, r.Environment)
+	if r.CodeVersion != "" {
+		hook.SetCodeVersion(r.CodeVersion)
+	}
+	if r.ServerHost != "" {
+		hook.SetServerHost(r.ServerHost)
+	}
+	if len(r.Custom) > 0 {
+		custom := make(map[string]interface{}, len(r.Custom))
+		for k, v := range r.Custom {
+			custom[k] = v
+		}
+		hook.SetCustom(custom)
+	}
+	r.client = hook.Client
+	return hook, nil
+}
+
+func (r *configRollbar) reportPanic() {
+	if p := recover(); p != nil {
+		r.client.LogPanic(p, true)
+		panic(p)
+	}
+}
+
+func (r *configRollbar) flush() {
+	r.client.Close()
+}
@@ -0,0 +1,111 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+)
+
+const dateLayout = "2006-01-02"
+
+// window returns the range of internal dates of messages to be forwarded,
+// a zero time means that the range is open on that side.
+func (s *fetchSource) window() (since, before time.Time, err error) {
+	now := time.Now()
+	if s.Since != "" {
+		since, err = time.ParseInLocation(dateLayout, s.Since, time.Local)
+		if err != nil {
+			return
+		}
+	}
+	if s.MaxAge > 0 {
+		if t := now.Add(-s.MaxAge); t.After(since) {
+			since = t
+		}
+	}
+	if s.MinAge > 0 {
+		before = now.Add(-s.MinAge)
+	}
+	return
+}
+
+func (s *fetchSource) validateWindow() error {
+	_, _, err := s.window()
+	if err != nil {
+		return fmt.Errorf("invalid since date: %w", err)
+	}
+	if s.MaxAge > 0 && s.MinAge >= s.MaxAge {
+		return fmt.Errorf("min age %s must be less than max age %s", s.MinAge, s.MaxAge)
+	}
+	return nil
+}
+
+func (s *fetchSource) validateSize() error {
+	if s.MaxSize > 0 && s.MinSize > s.MaxSize {
+		return fmt.Errorf("min size %d must not be greater than max size %d", s.MinSize, s.MaxSize)
+	}
+	return nil
+}
+
+func (s *fetchSource) inWindow(date time.Time) bool {
+	since, before, _ := s.window()
+	if date.IsZero() {
+		return true
+	}
+	if !since.IsZero() && date.Before(since) {
+		return false
+	}
+	if !before.IsZero() && !date.Before(before) {
+		return false
+	}
+	return true
+}
+
+// searchCriteria returns the criteria to pre-filter messages on the server
+// or nil if all messages are to be fetched.
+func (s *fetchSource) searchCriteria() (*imap.SearchCriteria, error) {
+	since, before, err := s.window()
+	if err != nil {
+		return nil, err
+	}
+	if since.IsZero() && before.IsZero() && s.MinSize == 0 && s.MaxSize == 0 {
+		return nil, nil
+	}
+
+	// SEARCH only compares dates without time, so the criteria
+	// include whole days and inWindow checks the exact time.
+	criteria := imap.NewSearchCriteria()
+	if !since.IsZero() {
+		criteria.Since = since
+	}
+	if !before.IsZero() {
+		criteria.Before = before.AddDate(0, 0, 1)
+	}
+	// LARGER and SMALLER exclude the given size, MinSize and MaxSize include it.
+	if s.MinSize > 0 {
+		criteria.Larger = s.MinSize - 1
+	}
+	if s.MaxSize > 0 {
+		criteria.Smaller = s.MaxSize + 1
+	}
+	return criteria, nil
+}
@@ -0,0 +1,102 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInWindowSince(t *testing.T) {
+	s := &fetchSource{Since: "2024-03-10"}
+	since := time.Date(2024, 3, 10, 0, 0, 0, 0, time.Local)
+	for date, want := range map[time.Time]bool{
+		since.Add(-time.Nanosecond): false,
+		since:                       true,
+		since.Add(time.Hour):        true,
+		{}:                          true,
+	} {
+		if got := s.inWindow(date); got != want {
+			t.Errorf("inWindow(%s): got %v, want %v", date, got, want)
+		}
+	}
+}
+
+func TestInWindowAge(t *testing.T) {
+	s := &fetchSource{MinAge: time.Hour, MaxAge: 24 * time.Hour}
+	now := time.Now()
+	for _, test := range []struct {
+		age  time.Duration
+		want bool
+	}{
+		{0, false},
+		{time.Hour - time.Second, false},
+		{time.Hour + time.Second, true},
+		{24*time.Hour - time.Second, true},
+		{24*time.Hour + time.Second, false},
+	} {
+		if got := s.inWindow(now.Add(-test.age)); got != test.want {
+			t.Errorf("inWindow(now - %s): got %v, want %v", test.age, got, test.want)
+		}
+	}
+}
+
+func TestSearchCriteria(t *testing.T) {
+	s := &fetchSource{}
+	criteria, err := s.searchCriteria()
+	if err != nil || criteria != nil {
+		t.Fatalf("searchCriteria without limits: got %v, %v, want nil", criteria, err)
+	}
+
+	s = &fetchSource{Since: "2024-03-10", MinSize: 100, MaxSize: 200}
+	criteria, err = s.searchCriteria()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 3, 10, 0, 0, 0, 0, time.Local); !criteria.Since.Equal(want) {
+		t.Errorf("Since: got %s, want %s", criteria.Since, want)
+	}
+	if !criteria.Before.IsZero() {
+		t.Errorf("Before: got %s, want none", criteria.Before)
+	}
+	// A message of exactly MinSize or MaxSize bytes is included.
+	if criteria.Larger != 99 || criteria.Smaller != 201 {
+		t.Errorf("Larger, Smaller: got %d, %d, want 99, 201", criteria.Larger, criteria.Smaller)
+	}
+}
+
+// SEARCH BEFORE compares dates without time, so a message which just became
+// old enough must not be excluded by the day it was received on.
+func TestSearchCriteriaMinAge(t *testing.T) {
+	s := &fetchSource{MinAge: 36 * time.Hour}
+	criteria, err := s.searchCriteria()
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	oldest := time.Now().Add(-36*time.Hour - time.Second)
+	if !day(oldest).Before(day(criteria.Before)) {
+		t.Errorf("Before %s excludes a message received at %s", criteria.Before, oldest)
+	}
+	if want := day(oldest).AddDate(0, 0, 2); !day(criteria.Before).Before(want) {
+		t.Errorf("Before %s includes messages received after %s", criteria.Before, want)
+	}
+}
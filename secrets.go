@@ -0,0 +1,89 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+)
+
+// resolveSecret returns the value of the environment variable or the
+// content of the file referenced by value, or value itself otherwise.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		data, err := os.ReadFile(strings.TrimPrefix(value, secretFilePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return value, nil
+}
+
+func (s *FetchServer) resolveSecrets() error {
+	password, err := resolveSecret(s.Password)
+	if err != nil {
+		return fmt.Errorf("password of %s: %w", s.Server, err)
+	}
+	s.Password = password
+	return nil
+}
+
+func (cfg *config) resolveSecrets() error {
+	if cfg.MQTT != nil {
+		password, err := resolveSecret(cfg.MQTT.Password)
+		if err != nil {
+			return fmt.Errorf("MQTT password: %w", err)
+		}
+		cfg.MQTT.Password = password
+	}
+	if cfg.Metrics != nil {
+		password, err := resolveSecret(cfg.Metrics.Password)
+		if err != nil {
+			return fmt.Errorf("metrics password: %w", err)
+		}
+		cfg.Metrics.Password = password
+	}
+	for _, c := range cfg.Accounts {
+		err := c.Source.resolveSecrets()
+		for _, t := range c.Target {
+			if err == nil {
+				err = t.resolveSecrets()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("account %s: %w", c.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	sentrylogrus "github.com/getsentry/sentry-go/logrus"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const sentryFlushTimeout = 5 * time.Second
+
+func (s *configSentry) name() string {
+	return "Sentry"
+}
+
+// hook returns a logging hook reporting errors to Sentry.
+func (s *configSentry) hook() (log.Hook, error) {
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:         s.DSN,
+		Environment: s.Environment,
+		Release:     s.Release,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	levels := []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+	return sentrylogrus.NewFromClient(levels, client), nil
+}
+
+func (s *configSentry) reportPanic() {
+	if p := recover(); p != nil {
+		sentry.NewHub(s.client, sentry.NewScope()).Recover(p)
+		s.client.Flush(sentryFlushTimeout)
+		panic(p)
+	}
+}
+
+func (s *configSentry) flush() {
+	s.client.Flush(sentryFlushTimeout)
+}
@@ -0,0 +1,164 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/emersion/go-imap"
+)
+
+// storeJob is a message passing all filters, to be stored on a target.
+type storeJob struct {
+	msg  *imap.Message
+	data []byte
+}
+
+// storeTracker records on how many targets a message still has to be
+// stored. A message is recorded in the checkpoint as soon as it is stored
+// on all targets, regardless of the order in which messages are stored.
+type storeTracker struct {
+	mutex   sync.Mutex
+	pending map[uint32]int
+}
+
+func newStoreTracker() *storeTracker {
+	return &storeTracker{pending: map[uint32]int{}}
+}
+
+func (s *storeTracker) add(uid uint32, targets int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending[uid] = targets
+}
+
+// done records that the message was stored on one target and reports
+// whether it is now stored on all of them, in which case it is saved.
+func (s *storeTracker) done(uid uint32, save func(uint32) error) (bool, error) {
+	s.mutex.Lock()
+	s.pending[uid]--
+	stored := s.pending[uid] <= 0
+	if stored {
+		delete(s.pending, uid)
+	}
+	s.mutex.Unlock()
+
+	if !stored {
+		return false, nil
+	}
+	return true, save(uid)
+}
+
+// lowestPending returns the lowest UID of the messages not yet stored on
+// all targets, or 0 if all messages were stored.
+func (s *storeTracker) lowestPending() uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lowest := uint32(0)
+	for uid := range s.pending {
+		if lowest == 0 || uid < lowest {
+			lowest = uid
+		}
+	}
+	return lowest
+}
+
+func (t *fetchTarget) appendConcurrency() int {
+	if t.AppendConcurrency > 1 {
+		return t.AppendConcurrency
+	}
+	return 1
+}
+
+// appenders returns the target itself and its additional workers.
+func (t *fetchTarget) appenders() []*fetchTarget {
+	return append([]*fetchTarget{t}, t.workers...)
+}
+
+// openWorkers opens the additional connections appending messages in
+// parallel, they are counted as connections of the target.
+func (t *fetchTarget) openWorkers() error {
+	for i := 1; i < t.appendConcurrency(); i++ {
+		w := *t
+		w.imapconn = nil
+		w.workers = nil
+		err := w.openIMAP()
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&t.connections, 1)
+		t.workers = append(t.workers, &w)
+	}
+	return nil
+}
+
+// prepareWorkers selects the target mailbox on the additional connections
+// and shares the rate limit of the target with them.
+func (t *fetchTarget) prepareWorkers() error {
+	for _, w := range t.workers {
+		_, err := w.selectIMAP()
+		if err != nil {
+			return err
+		}
+		w.mailbox = t.mailbox
+		w.folders = map[string]bool{}
+		w.limiter = t.limiter
+	}
+	return nil
+}
+
+func (t *fetchTarget) closeWorkers() error {
+	var errs []error
+	for _, w := range t.workers {
+		errs = append(errs, w.closeIMAP())
+		atomic.AddInt64(&t.connections, -1)
+	}
+	t.workers = nil
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendMessages stores the messages of one target connection and passes
+// them on for deletion once they are stored on all targets. Messages not
+// confirmed to be stored on all targets are never deleted.
+func (c *fetchConfig) appendMessages(t *fetchTarget, jobs <-chan *storeJob, tracker *storeTracker, deletes chan<- uint32) error {
+	for job := range jobs {
+		err := t.storeMessage(job.msg, job.data)
+		if err != nil {
+			return err
+		}
+		stored, err := tracker.done(job.msg.Uid, c.Source.saveCheckpoint)
+		if err != nil {
+			return err
+		}
+		if stored {
+			atomic.AddUint64(&c.total, 1)
+			atomic.AddUint64(&c.totalBytes, uint64(len(job.data)))
+			// Even if storing other messages failed, a stored message must
+			// be deleted, the cleaning stage drains all deletes.
+			deletes <- job.msg.Uid
+		}
+	}
+	return nil
+}
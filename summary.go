@@ -0,0 +1,44 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logSummary logs what the account did since it was started, so that a
+// run can be reviewed after the fact.
+func (c *fetchConfig) logSummary(started time.Time) {
+	for mailbox, m := range c.mailboxConfigs() {
+		fields := log.Fields{
+			"mailbox":     mailbox,
+			"messages":    atomic.LoadUint64(&m.total),
+			"failures":    atomic.LoadUint64(&m.failures),
+			"uptime":      time.Since(started).Round(time.Second).String(),
+			"final_state": m.lastState.name(),
+		}
+		if m.lastErr != nil {
+			fields["last_error"] = m.lastErr.Error()
+		}
+		m.log().WithFields(fields).Info("Account summary")
+	}
+}
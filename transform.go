@@ -0,0 +1,74 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+
+	textproto "github.com/emersion/go-message/textproto"
+)
+
+type fetchTransform struct {
+	AddHeaders         map[string]string
+	RemoveHeaders      []string
+	StoreUntransformed bool
+}
+
+func (t *fetchTransform) enabled() bool {
+	return len(t.AddHeaders) > 0 || len(t.RemoveHeaders) > 0
+}
+
+// apply rewrites the message header, leaving the body untouched.
+func (t *fetchTransform) apply(data []byte) ([]byte, error) {
+	if !t.enabled() {
+		return data, nil
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	header, err := textproto.ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range t.RemoveHeaders {
+		header.Del(key)
+	}
+	keys := make([]string, 0, len(t.AddHeaders))
+	for key := range t.AddHeaders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		header.Add(key, t.AddHeaders[key])
+	}
+
+	var buf bytes.Buffer
+	err = textproto.WriteHeader(&buf, header)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(&buf, r)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,62 @@
+/*
+	go-getmail - Retrieve and forward e-mails between IMAP servers.
+	Copyright (C) 2019  Marc Hoersken <info@marc-hoersken.de>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+)
+
+func TestStoreMessageTransformFailure(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	c := newTestConfig(t, source, target)
+	c.Target[0].Transform.AddHeaders = map[string]string{"X-Forwarded-By": "go-getmail"}
+	err := c.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.bind()
+	tgt := c.Target[0]
+	err = tgt.openIMAP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.closeIMAP()
+	err = tgt.prepareStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.finishStore()
+
+	msg := &imap.Message{Uid: 1}
+	data := []byte("Subject: malformed\r\nnot a header field\r\n\r\nBody")
+	err = tgt.storeMessage(msg, data)
+	if err == nil {
+		t.Error("transform failure did not fail the message")
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"))
+
+	tgt.Transform.StoreUntransformed = true
+	err = tgt.storeMessage(msg, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSubjects(t, "target", target.subjects(t, "INBOX"), "malformed")
+}